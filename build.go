@@ -0,0 +1,141 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	zipfly "github.com/baptistejub/zipfly/zip_fly"
+)
+
+// Builds an archive from a manifest file, as the server would stream it
+func build(args []string) error {
+	flags := flag.NewFlagSet("zipfly build", flag.ContinueOnError)
+	manifestPath := flags.String("m", "", "path to the JSON manifest, - for stdin (mandatory)")
+	outputPath := flags.String("o", "", "path of the archive to write, - for stdout (defaults to the manifest filename, in the working directory)")
+	quiet := flags.Bool("q", false, "do not display the progress")
+	names := flags.String("names", string(zipfly.NameWindowsSafe), "entry names sanitization: windows, strict or passthrough")
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if *manifestPath == "" {
+		flags.Usage()
+		return errors.New("missing manifest path")
+	}
+
+	manifest, err := readInput(*manifestPath)
+	if err != nil {
+		return err
+	}
+
+	payload, err := zipfly.UnmarshalPayload(manifest)
+	if err != nil {
+		return fmt.Errorf("invalid manifest: %w", err)
+	}
+
+	zipStreamer, err := zipfly.NewZipStreamerWithOptions(payload.Files, zipfly.StreamerOptions{
+		NamePolicy:   zipfly.NamePolicy(*names),
+		OnDuplicate:  payload.OnDuplicate,
+		OnError:      payload.OnError,
+		ErrorReport:  payload.ErrorReport,
+		Checksums:    payload.Checksums,
+		NameEncoding: payload.NameEncoding,
+		Comment:      payload.Comment,
+	})
+	if err != nil {
+		return fmt.Errorf("invalid manifest: %w", err)
+	}
+
+	if !*quiet {
+		for _, change := range zipStreamer.Renamed {
+			fmt.Fprintf(os.Stderr, "Renamed %s to %s\n", change.Original, change.Sanitized)
+		}
+		for _, skipped := range zipStreamer.Skipped {
+			fmt.Fprintf(os.Stderr, "Skipped duplicate %s\n", skipped)
+		}
+	}
+
+	// the manifest can't choose a path outside of the working directory
+	if *outputPath == "" {
+		*outputPath = zipfly.ArchiveFilename(payload.Filename)
+	}
+
+	if !*quiet {
+		zipStreamer.OnProgress = progressPrinter(os.Stderr, len(zipStreamer.Entries))
+	}
+
+	if *outputPath == "-" {
+		return zipStreamer.StreamFiles(os.Stdout)
+	}
+
+	output, err := os.Create(*outputPath)
+	if err != nil {
+		return err
+	}
+
+	err = zipStreamer.StreamFiles(output)
+	if closeErr := output.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		// don't leave a truncated archive behind
+		os.Remove(*outputPath)
+		return err
+	}
+
+	if !*quiet {
+		for _, failure := range zipStreamer.Failed {
+			fmt.Fprintf(os.Stderr, "Skipped failed file %s: %s\n", failure.Path, failure.Error)
+		}
+		fmt.Fprintln(os.Stderr, "Archive written to", *outputPath)
+	}
+
+	return nil
+}
+
+func readInput(path string) ([]byte, error) {
+	if path == "-" {
+		return io.ReadAll(os.Stdin)
+	}
+
+	return os.ReadFile(path)
+}
+
+func progressPrinter(w io.Writer, total int) func(zipfly.ProgressEvent) {
+	start := time.Now()
+
+	return func(event zipfly.ProgressEvent) {
+		if !event.Done {
+			return
+		}
+
+		if event.Err != nil {
+			fmt.Fprintf(w, "[%d/%d] %s failed, skipped: %s\n", event.Index+1, total, event.Entry.ZipPath, event.Err)
+			return
+		}
+
+		fmt.Fprintf(w, "[%d/%d] %s %s (archive: %s, %s)\n", event.Index+1, total, event.Entry.ZipPath,
+			formatBytes(event.EntryBytes), formatBytes(event.ArchiveBytes), time.Since(start).Round(time.Millisecond))
+	}
+}
+
+func formatBytes(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
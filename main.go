@@ -2,6 +2,10 @@ package main
 
 import (
 	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"os"
@@ -12,50 +16,196 @@ import (
 	zipfly "github.com/baptistejub/zipfly/zip_fly"
 )
 
+// Time given to the remaining connections (e.g. progress events) once the archives are done
+const shutdownTimeout = 5 * time.Second
+
+const usage = `Usage:
+  zipfly [serve] [flags]                        start the server
+  zipfly config print [flags]                   print the effective configuration, secrets masked
+  zipfly build -m manifest.json [-o out.zip]    build an archive from a manifest file, without the server
+
+Run "zipfly serve -h" to list the flags.
+`
+
 func main() {
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "6969"
+	args := os.Args[1:]
+	command := "serve"
+	if len(args) > 0 && args[0] != "" && args[0][0] != '-' {
+		command, args = args[0], args[1:]
 	}
 
-	publicUrl := os.Getenv("PUBLIC_URL")
-	if publicUrl == "" {
-		host, err := os.Hostname()
-		if err != nil {
-			panic(err)
+	var err error
+	switch command {
+	case "serve":
+		err = serve(args)
+	case "build":
+		err = build(args)
+	case "config":
+		if len(args) == 0 || args[0] != "print" {
+			fmt.Fprint(os.Stderr, usage)
+			os.Exit(2)
 		}
+		err = printConfig(args[1:])
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
 
-		publicUrl = "http://" + host + ":" + port
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		os.Exit(1)
 	}
+}
 
-	environment := os.Getenv("ENVIRONMENT")
-	if environment == "" {
-		environment = "development"
+func loadConfig(name string, args []string) (*zipfly.Config, error) {
+	config, err := zipfly.LoadConfig(name, args)
+	if err != nil {
+		return nil, err
 	}
 
-	validateSignature := os.Getenv("VALIDATE_SIGNATURE") != ""
-	options := zipfly.ServerOptions{
-		ValidateSignature: validateSignature,
-		SigningSecret:     os.Getenv("SIGNING_SECRET"),
-		PublicUrl:         publicUrl,
+	if err := config.Validate(); err != nil {
+		return config, fmt.Errorf("invalid configuration:\n%w", err)
 	}
 
+	return config, nil
+}
+
+func printConfig(args []string) error {
+	config, err := loadConfig("zipfly config print", args)
+	if config != nil {
+		if printErr := config.Print(os.Stdout); printErr != nil {
+			return printErr
+		}
+	}
+
+	return err
+}
+
+func serve(args []string) error {
+	config, err := loadConfig("zipfly serve", args)
+	if err != nil {
+		return err
+	}
+
+	shutdownTracing, err := zipfly.SetupTracing(context.Background(), config.TracesExporter)
+	if err != nil {
+		return err
+	}
+
+	options, err := config.ServerOptions()
+	if err != nil {
+		return err
+	}
+
+	server := zipfly.NewServer(config.Environment, options)
 	httpServer := &http.Server{
-		Addr:        ":" + port,
-		Handler:     zipfly.NewServer(environment, options),
-		ReadTimeout: 10 * time.Second,
+		Addr:         ":" + config.Port,
+		Handler:      server,
+		ReadTimeout:  config.ReadTimeout,
+		WriteTimeout: config.WriteTimeout,
+		IdleTimeout:  config.IdleTimeout,
 	}
 
+	listenErr := make(chan error, 1)
 	go func() {
-		httpServer.ListenAndServe()
+		listenErr <- httpServer.ListenAndServe()
 	}()
 
-	log.Printf("Server started on port %s", port)
+	log.Printf("Server started on port %s", config.Port)
+
+	if options.SigningKeys != nil {
+		go reloadSigningKeys(options.SigningKeys, config.SigningKeysReload)
+	}
+
+	for _, tenant := range options.Tenants {
+		if tenant.SigningKeys != nil {
+			go reloadSigningKeys(tenant.SigningKeys, config.SigningKeysReload)
+		}
+	}
+
+	if options.TokenVerifier != nil {
+		go reloadJWKS(options.TokenVerifier)
+		go options.TokenVerifier.Refresh(context.Background())
+	}
 
 	// Gracefully shutdown when SIGTERM is received
-	sig := make(chan os.Signal, 1)
+	sig := make(chan os.Signal, 2)
 	signal.Notify(sig, os.Interrupt, syscall.SIGINT, syscall.SIGTERM)
-	<-sig
+	select {
+	case <-sig:
+	case err := <-listenErr:
+		return err
+	}
+
+	// a second signal doesn't wait for the streams
+	go func() {
+		<-sig
+		log.Printf("Forced exit")
+		os.Exit(1)
+	}()
+
+	log.Printf("Draining, waiting up to %s for the archives being streamed...", config.ShutdownGracePeriod)
+	drainCtx, cancel := context.WithTimeout(context.Background(), config.ShutdownGracePeriod)
+	defer cancel()
+	if err := server.Drain(drainCtx); err != nil {
+		log.Printf("Grace period over, remaining archives aborted")
+	}
+
 	log.Printf("Shutting down...")
-	httpServer.Shutdown(context.Background())
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancelShutdown()
+	if err := httpServer.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Couldn't close the connections gracefully: %v", err)
+		httpServer.Close()
+	}
+	shutdownTracing(context.Background())
+
+	if closer, ok := options.NonceStore.(io.Closer); ok {
+		closer.Close()
+	}
+
+	return nil
+}
+
+// Reloads the signing keys on SIGHUP, and when the file changes if an interval is given
+func reloadSigningKeys(keys *zipfly.KeySet, interval time.Duration) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	var tick <-chan time.Time
+	if interval > 0 {
+		tick = time.NewTicker(interval).C
+	}
+
+	for {
+		var err error
+		select {
+		case <-hup:
+			log.Printf("Reloading signing keys...")
+			err = keys.Reload()
+		case <-tick:
+			err = keys.ReloadIfModified()
+		}
+
+		if err != nil {
+			log.Printf("Couldn't reload signing keys, keeping the current ones: %v", err)
+		}
+	}
+}
+
+// Reloads the JWKS on SIGHUP
+func reloadJWKS(verifier *zipfly.TokenVerifier) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	for range hup {
+		log.Printf("Reloading JWKS...")
+		if err := verifier.Reload(); err != nil {
+			log.Printf("Couldn't reload JWKS, keeping the current keys: %v", err)
+		}
+	}
 }
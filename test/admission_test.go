@@ -0,0 +1,208 @@
+package testing
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	zipfly "github.com/baptistejub/zipfly/zip_fly"
+)
+
+func queueDepth(t *testing.T, server *zipfly.Server) string {
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+
+	for _, line := range strings.Split(w.Body.String(), "\n") {
+		if value, ok := strings.CutPrefix(line, "zipfly_queue_depth "); ok {
+			return value
+		}
+	}
+
+	t.Fatalf("no queue depth in metrics: %s", w.Body.String())
+	return ""
+}
+
+func waitQueueDepth(t *testing.T, server *zipfly.Server, depth string) {
+	for i := 0; queueDepth(t, server) != depth; i++ {
+		if i > 100 {
+			t.Fatalf("queue depth never reached %s", depth)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestAdmissionQueueFairness(t *testing.T) {
+	var mu sync.Mutex
+	var order []string
+	started := make(chan struct{})
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := r.URL.Query().Get("name")
+		if name == "first" {
+			close(started)
+			<-release
+		}
+		mu.Lock()
+		order = append(order, name)
+		mu.Unlock()
+		w.Write([]byte(name))
+	}))
+	defer upstream.Close()
+
+	server := zipfly.NewServer("test", zipfly.ServerOptions{RateLimit: zipfly.RateLimitOptions{GlobalStreams: 1, QueueSize: 3, QueueMaxWait: 5 * time.Second}})
+	post := func(ip, name string) *httptest.ResponseRecorder {
+		body := `{"files":[{"url":"` + upstream.URL + `?name=` + name + `","filename":"a.txt"}]}`
+		req := httptest.NewRequest("POST", "/zip", bytes.NewReader([]byte(body)))
+		req.RemoteAddr = ip + ":1234"
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, req)
+		return w
+	}
+
+	var wg sync.WaitGroup
+	start := func(ip, name string) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if w := post(ip, name); w.Code != http.StatusOK {
+				t.Errorf("%s rejected: %v", name, w.Code)
+			}
+		}()
+	}
+
+	start("10.0.0.1", "first")
+	<-started
+	// queued in this order
+	start("10.0.0.2", "a1")
+	waitQueueDepth(t, server, "1")
+	start("10.0.0.2", "a2")
+	waitQueueDepth(t, server, "2")
+	start("10.0.0.3", "b1")
+	waitQueueDepth(t, server, "3")
+
+	if w := post("10.0.0.4", "full"); w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") != "5" {
+		t.Fatalf("request accepted with a full queue: %v", w.Code)
+	}
+
+	close(release)
+	wg.Wait()
+
+	if strings.Join(order, ",") != "first,a1,b1,a2" {
+		t.Fatalf("unfair admission order: %v", order)
+	}
+}
+
+func TestAdmissionQueueTimeout(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	}))
+	defer upstream.Close()
+	defer close(release)
+
+	server := zipfly.NewServer("test", zipfly.ServerOptions{RateLimit: zipfly.RateLimitOptions{GlobalStreams: 1, QueueSize: 1, QueueMaxWait: 50 * time.Millisecond}})
+	body := `{"files":[{"url":"` + upstream.URL + `","filename":"a.txt"}]}`
+
+	go postFrom(server, "10.0.0.1", body)
+	<-started
+
+	w := postFrom(server, "10.0.0.2", body)
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") != "1" {
+		t.Fatalf("request not timed out in the queue: %v", w.Code)
+	}
+}
+
+func TestQueueRejectionKeepsLinkUse(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("block") != "" {
+			close(started)
+			<-release
+		}
+		w.Write([]byte("Hello, world!"))
+	}))
+	defer upstream.Close()
+
+	server := zipfly.NewServer("test", zipfly.ServerOptions{RateLimit: zipfly.RateLimitOptions{GlobalStreams: 1, QueueSize: 1, QueueMaxWait: 50 * time.Millisecond}})
+
+	blocked := make(chan struct{})
+	go func() {
+		postFrom(server, "10.0.0.1", `{"files":[{"url":"`+upstream.URL+`?block=1","filename":"a.txt"}]}`)
+		close(blocked)
+	}()
+	<-started
+
+	linked := func() int {
+		req := httptest.NewRequest("POST", "/zip", strings.NewReader(`{"nonce":"once","files":[{"url":"`+upstream.URL+`","filename":"a.txt"}]}`))
+		req.Header.Set("X-Zipfly-Expires", strconv.FormatInt(time.Now().Add(time.Minute).Unix(), 10))
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	if code := linked(); code != http.StatusServiceUnavailable {
+		t.Fatalf("request not timed out in the queue: %v", code)
+	}
+
+	close(release)
+	<-blocked
+
+	if code := linked(); code != http.StatusOK {
+		t.Fatalf("link used up by the rejected request: %v", code)
+	}
+}
+
+func TestQueueUnauthorizedRequests(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("block") != "" {
+			close(started)
+			<-release
+		}
+		w.Write([]byte("Hello, world!"))
+	}))
+	defer upstream.Close()
+	var unblock sync.Once
+	defer unblock.Do(func() { close(release) })
+
+	server := zipfly.NewServer("production", zipfly.ServerOptions{
+		SigningSecret: "secret",
+		RateLimit:     zipfly.RateLimitOptions{GlobalStreams: 1, QueueSize: 1, QueueMaxWait: 5 * time.Second},
+	})
+	post := func(body, secret string) int {
+		expires := strconv.FormatInt(time.Now().Add(time.Minute).Unix(), 10)
+		req := httptest.NewRequest("POST", "/zip", strings.NewReader(body))
+		req.Header.Set("X-Zipfly-Expires", expires)
+		req.Header.Set("X-Zipfly-Signature", sign(expires+":"+body, secret))
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, req)
+		return w.Code
+	}
+	body := `{"files":[{"url":"` + upstream.URL + `","filename":"a.txt"}]}`
+
+	go post(`{"files":[{"url":"`+upstream.URL+`?block=1","filename":"a.txt"}]}`, "secret")
+	<-started
+
+	// rejected without waiting for a slot
+	if code := post(body, "wrong"); code != http.StatusForbidden {
+		t.Fatalf("unauthorized request not rejected before the queue: %v", code)
+	}
+
+	queued := make(chan int)
+	go func() { queued <- post(body, "secret") }()
+	waitQueueDepth(t, server, "1")
+	unblock.Do(func() { close(release) })
+
+	if code := <-queued; code != http.StatusOK {
+		t.Fatalf("queued request failed: %v", code)
+	}
+}
@@ -0,0 +1,92 @@
+package testing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	zipfly "github.com/baptistejub/zipfly/zip_fly"
+)
+
+// Sends some bytes then waits for the request to be canceled
+func stallingUpstream(canceled chan struct{}, started chan struct{}) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("Hello"))
+		w.(http.Flusher).Flush()
+		close(started)
+
+		select {
+		case <-r.Context().Done():
+			close(canceled)
+		case <-time.After(5 * time.Second):
+		}
+	}))
+}
+
+func TestClientAbortCancelsUpstream(t *testing.T) {
+	canceled, started := make(chan struct{}), make(chan struct{})
+	upstream := stallingUpstream(canceled, started)
+	defer upstream.Close()
+
+	s, err := zipfly.NewZipStreamer([]zipfly.File{{Url: upstream.URL, Filename: "a.txt"}, {Url: upstream.URL, Filename: "b.txt"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-started
+		cancel()
+	}()
+
+	err = s.StreamFilesContext(ctx, io.Discard)
+	if !errors.Is(err, zipfly.ErrClientAborted) {
+		t.Fatalf("expected a client abort, got %v", err)
+	}
+
+	select {
+	case <-canceled:
+	case <-time.After(time.Second):
+		t.Fatalf("upstream request not canceled")
+	}
+}
+
+func TestClientAbortWebhook(t *testing.T) {
+	canceled, started := make(chan struct{}), make(chan struct{})
+	upstream := stallingUpstream(canceled, started)
+	defer upstream.Close()
+
+	received := make(chan map[string]interface{}, 1)
+	callback := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		event := make(map[string]interface{})
+		json.NewDecoder(r.Body).Decode(&event)
+		received <- event
+	}))
+	defer callback.Close()
+
+	body := []byte(`{"callback_url":"` + callback.URL + `","files":[{"url":"` + upstream.URL + `","filename":"a.txt"}]}`)
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-started
+		cancel()
+	}()
+
+	req := httptest.NewRequest("POST", "/zip", bytes.NewReader(body)).WithContext(ctx)
+	options := zipfly.ServerOptions{SigningSecret: "secret", Webhook: zipfly.WebhookOptions{AllowPrivateNetworks: true}}
+	zipfly.NewServer("test", options).ServeHTTP(httptest.NewRecorder(), req)
+
+	select {
+	case event := <-received:
+		if event["event"] != "archive.aborted" || event["aborted"] != true {
+			t.Fatalf("invalid webhook event: %v", event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no webhook event")
+	}
+}
@@ -0,0 +1,71 @@
+package testing
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	zipfly "github.com/baptistejub/zipfly/zip_fly"
+)
+
+// SHA-256 of "Hello, world!"
+const helloSha256 = "315f5bdb76d078c43b8ac0064e4a0164612b1fce77c869345bfc94c75894edd3"
+
+func streamWithChecksums(t *testing.T, format zipfly.ChecksumFormat, files []zipfly.File) []byte {
+	s, err := zipfly.NewZipStreamerWithOptions(files, zipfly.StreamerOptions{Checksums: format})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := new(bytes.Buffer)
+	if err := s.StreamFiles(w); err != nil {
+		t.Fatal(err)
+	}
+
+	return w.Bytes()
+}
+
+func TestSha256Sums(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("Hello, world!"))
+	}))
+	defer upstream.Close()
+
+	archive := streamWithChecksums(t, zipfly.ChecksumSha256Sums, []zipfly.File{
+		{Url: upstream.URL, Filename: "a.txt"},
+		{Url: upstream.URL, Filename: "dir/b.txt", Compress: true},
+		{Url: upstream.URL, Filename: "SHA256SUMS"},
+	})
+
+	expected := helloSha256 + "  a.txt\n" + helloSha256 + "  dir/b.txt\n" + helloSha256 + "  SHA256SUMS\n"
+	if sums := readZipFile(t, archive, "SHA256SUMS (1)"); sums != expected {
+		t.Fatalf("unexpected checksums: %s", sums)
+	}
+}
+
+func TestChecksumManifest(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("Hello, world!"))
+	}))
+	defer upstream.Close()
+
+	archive := streamWithChecksums(t, zipfly.ChecksumManifest, []zipfly.File{{Url: upstream.URL, Filename: "a.txt"}})
+
+	var manifest struct {
+		Files []zipfly.EntryChecksum `json:"files"`
+	}
+	if err := json.Unmarshal([]byte(readZipFile(t, archive, "manifest.json")), &manifest); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := zipfly.EntryChecksum{Path: "a.txt", Size: 13, Sha256: helloSha256, Url: upstream.URL}
+	if len(manifest.Files) != 1 || manifest.Files[0] != expected {
+		t.Fatalf("unexpected manifest: %v", manifest.Files)
+	}
+
+	if _, err := zipfly.NewZipStreamerWithOptions([]zipfly.File{{Url: upstream.URL, Filename: "a.txt"}}, zipfly.StreamerOptions{Checksums: "md5"}); err == nil {
+		t.Fatalf("unknown format accepted")
+	}
+}
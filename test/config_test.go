@@ -0,0 +1,118 @@
+package testing
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	zipfly "github.com/baptistejub/zipfly/zip_fly"
+)
+
+func writeConfigFile(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "zipfly.yml")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func TestLoadConfigDefaults(t *testing.T) {
+	c, err := zipfly.LoadConfig("test", []string{"-public-url", "http://localhost"})
+
+	if err != nil {
+		t.Fatalf("couldn't load config: %v", err)
+	}
+
+	if c.Port != "6969" || c.Environment != "development" || c.ReadTimeout != 10*time.Second {
+		t.Fatalf("invalid defaults: %+v", c)
+	}
+
+	if err := c.Validate(); err != nil {
+		t.Fatalf("invalid default config: %v", err)
+	}
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	path := writeConfigFile(t, "port: \"7000\"\nenvironment: staging\nread_timeout: 5s\nupstream:\n  dial_timeout: 2s\n")
+	t.Setenv("ENVIRONMENT", "preprod")
+	t.Setenv("UPSTREAM_DIAL_TIMEOUT", "3s")
+
+	c, err := zipfly.LoadConfig("test", []string{"-config", path, "-upstream-dial-timeout", "4s"})
+
+	if err != nil {
+		t.Fatalf("couldn't load config: %v", err)
+	}
+
+	if c.Port != "7000" || c.ReadTimeout != 5*time.Second {
+		t.Fatalf("config file not applied: %+v", c)
+	}
+
+	if c.Environment != "preprod" {
+		t.Fatalf("env not applied: %s", c.Environment)
+	}
+
+	if c.Upstream.DialTimeout != 4*time.Second {
+		t.Fatalf("flag not applied: %v", c.Upstream.DialTimeout)
+	}
+}
+
+func TestLoadConfigUnknownKey(t *testing.T) {
+	path := writeConfigFile(t, "prot: \"7000\"\n")
+
+	if _, err := zipfly.LoadConfig("test", []string{"-config", path}); err == nil {
+		t.Fatalf("accepted unknown config key")
+	}
+}
+
+func TestLoadConfigInvalidEnv(t *testing.T) {
+	t.Setenv("READ_TIMEOUT", "ten")
+
+	_, err := zipfly.LoadConfig("test", []string{})
+
+	if err == nil || !strings.Contains(err.Error(), "READ_TIMEOUT") {
+		t.Fatalf("invalid env error: %v", err)
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	c := zipfly.DefaultConfig()
+	c.Port = "abc"
+	c.PublicUrl = "http://localhost"
+	c.Environment = "production"
+
+	err := c.Validate()
+
+	if err == nil || !strings.Contains(err.Error(), "port") || !strings.Contains(err.Error(), "signing_secret") {
+		t.Fatalf("invalid validation errors: %v", err)
+	}
+}
+
+func TestConfigPrintMasksSecrets(t *testing.T) {
+	c := zipfly.DefaultConfig()
+	c.SigningSecret = "my-secret"
+	w := new(bytes.Buffer)
+
+	if err := c.Print(w); err != nil {
+		t.Fatalf("couldn't print config: %v", err)
+	}
+
+	if strings.Contains(w.String(), "my-secret") || !strings.Contains(w.String(), "signing_secret") {
+		t.Fatalf("secret not masked:\n%s", w.String())
+	}
+}
+
+func TestValidateSignatureEnv(t *testing.T) {
+	// any non-empty value enables it, as in the first versions
+	for value, enabled := range map[string]bool{"true": true, "false": true, "yes": true, "": false} {
+		t.Setenv("VALIDATE_SIGNATURE", value)
+
+		c, err := zipfly.LoadConfig("test", []string{})
+		if err != nil || c.ValidateSignature != enabled {
+			t.Errorf("VALIDATE_SIGNATURE=%q: %v %v", value, c, err)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package testing
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	zipfly "github.com/baptistejub/zipfly/zip_fly"
+)
+
+func TestContentDisposition(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("Hello, world!"))
+	}))
+	defer upstream.Close()
+
+	expected := map[string]string{
+		"":                        `attachment; filename="archive.zip"`,
+		"photos":                  `attachment; filename="photos.zip"`,
+		"../dir/backup.ZIP":       `attachment; filename="backup.ZIP"`,
+		"Résumé \"final\"\r\n":    `attachment; filename="Resume _final_.zip"; filename*=UTF-8''R%C3%A9sum%C3%A9%20_final_.zip`,
+		"日本.zip":                  `attachment; filename="__.zip"; filename*=UTF-8''%E6%97%A5%E6%9C%AC.zip`,
+		"report; filename=x.html": `attachment; filename="report; filename=x.html.zip"`,
+	}
+
+	server := zipfly.NewServer("test", zipfly.ServerOptions{})
+	for filename, header := range expected {
+		body, _ := json.Marshal(map[string]interface{}{
+			"filename": filename,
+			"files":    []zipfly.File{{Url: upstream.URL, Filename: "a.txt"}},
+		})
+
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, httptest.NewRequest("POST", "/zip", bytes.NewReader(body)))
+
+		if got := w.Header().Get("Content-Disposition"); got != header {
+			t.Errorf("%q: got %s, expected %s", filename, got, header)
+		}
+	}
+}
+
+func TestArchiveFilename(t *testing.T) {
+	expected := map[string]string{
+		"../../etc/x":   "x.zip",
+		"/tmp/out.zip":  "out.zip",
+		"..\\..\\a.zip": "a.zip",
+		"..":            "archive.zip",
+	}
+
+	for filename, name := range expected {
+		if got := zipfly.ArchiveFilename(filename); got != name {
+			t.Errorf("%q: got %q, expected %q", filename, got, name)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package testing
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	zipfly "github.com/baptistejub/zipfly/zip_fly"
+)
+
+func TestDrainAbortsRemainingStreams(t *testing.T) {
+	canceled, started := make(chan struct{}), make(chan struct{})
+	upstream := stallingUpstream(canceled, started)
+	defer upstream.Close()
+
+	server := zipfly.NewServer("test", zipfly.ServerOptions{})
+	body := `{"files":[{"url":"` + upstream.URL + `","filename":"a.txt"}]}`
+
+	streamDone := make(chan struct{})
+	go func() {
+		server.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/zip", bytes.NewReader([]byte(body))))
+		close(streamDone)
+	}()
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	drained := make(chan error, 1)
+	go func() {
+		drained <- server.Drain(ctx)
+	}()
+
+	// wait for the drain to start
+	for !server.Draining() {
+		time.Sleep(time.Millisecond)
+	}
+
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, httptest.NewRequest("GET", "/readyz", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("ready while draining: %v", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	server.ServeHTTP(w, httptest.NewRequest("POST", "/zip", bytes.NewReader([]byte(body))))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("new archive accepted while draining: %v", w.Code)
+	}
+
+	if err := <-drained; err != context.DeadlineExceeded {
+		t.Fatalf("expected the grace period to expire, got %v", err)
+	}
+
+	select {
+	case <-streamDone:
+	default:
+		t.Fatalf("stream still running after the drain")
+	}
+}
+
+func TestDrainWithoutStreams(t *testing.T) {
+	server := zipfly.NewServer("test", zipfly.ServerOptions{})
+
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, httptest.NewRequest("GET", "/readyz", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("not ready: %v", w.Code)
+	}
+
+	if err := server.Drain(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,55 @@
+package testing
+
+import (
+	"strings"
+	"testing"
+
+	zipfly "github.com/baptistejub/zipfly/zip_fly"
+)
+
+func duplicateEntries(policy zipfly.DuplicatePolicy) ([]string, error) {
+	files := []zipfly.File{
+		{Url: "https://test.com/1", Filename: "photo.jpg"},
+		{Url: "https://test.com/2", Filename: "Photo.JPG"},
+		{Url: "https://test.com/3", Filename: "photo (1).jpg"},
+		{Url: "https://test.com/4", Filename: "/photo.jpg"},
+		{Url: "https://test.com/5", Filename: "dir/.env"},
+		{Url: "https://test.com/6", Filename: "dir/.env"},
+	}
+
+	s, err := zipfly.NewZipStreamerWithOptions(files, zipfly.StreamerOptions{OnDuplicate: policy})
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]string, len(s.Entries))
+	for i, entry := range s.Entries {
+		entries[i] = entry.Url[len("https://test.com/"):] + ":" + entry.ZipPath
+	}
+
+	return entries, nil
+}
+
+func TestDuplicatePolicies(t *testing.T) {
+	expected := map[zipfly.DuplicatePolicy]string{
+		zipfly.DuplicateRename:   "1:photo.jpg,2:Photo (1).JPG,3:photo (1) (1).jpg,4:photo (2).jpg,5:dir/.env,6:dir/.env (1)",
+		"":                       "1:photo.jpg,2:Photo (1).JPG,3:photo (1) (1).jpg,4:photo (2).jpg,5:dir/.env,6:dir/.env (1)",
+		zipfly.DuplicateSkip:     "1:photo.jpg,3:photo (1).jpg,5:dir/.env",
+		zipfly.DuplicateLastWins: "3:photo (1).jpg,4:photo.jpg,6:dir/.env",
+	}
+
+	for policy, paths := range expected {
+		entries, err := duplicateEntries(policy)
+		if err != nil || strings.Join(entries, ",") != paths {
+			t.Errorf("%q: got %v (%v), expected %s", policy, entries, err, paths)
+		}
+	}
+
+	if _, err := duplicateEntries(zipfly.DuplicateError); err == nil {
+		t.Errorf("duplicates accepted")
+	}
+
+	if _, err := duplicateEntries("overwrite"); err == nil {
+		t.Errorf("unknown policy accepted")
+	}
+}
@@ -0,0 +1,173 @@
+package testing
+
+import (
+	"archive/zip"
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	zipfly "github.com/baptistejub/zipfly/zip_fly"
+)
+
+func streamWithMissingFile(t *testing.T, options zipfly.StreamerOptions, optional bool) (*zipfly.ZipStreamer, []byte, error) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte("Hello, world!"))
+	}))
+	t.Cleanup(upstream.Close)
+
+	files := []zipfly.File{
+		{Url: upstream.URL + "/found", Filename: "found.txt"},
+		{Url: upstream.URL + "/missing", Filename: "missing.txt", Optional: optional},
+	}
+
+	s, err := zipfly.NewZipStreamerWithOptions(files, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := new(bytes.Buffer)
+	err = s.StreamFiles(w)
+
+	return s, w.Bytes(), err
+}
+
+func readZipFile(t *testing.T, archive []byte, name string) string {
+	r, err := zip.NewReader(bytes.NewReader(archive), int64(len(archive)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := r.Open(name)
+	if err != nil {
+		t.Fatalf("%s not in the archive: %v", name, err)
+	}
+	defer f.Close()
+
+	content, _ := io.ReadAll(f)
+	return string(content)
+}
+
+func TestSkipFailedFiles(t *testing.T) {
+	s, archive, err := streamWithMissingFile(t, zipfly.StreamerOptions{OnError: zipfly.ErrorSkip}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(s.Failed) != 1 || s.Failed[0].Path != "missing.txt" {
+		t.Fatalf("unexpected failures: %v", s.Failed)
+	}
+
+	if readZipFile(t, archive, "found.txt") != "Hello, world!" {
+		t.Fatalf("missing content")
+	}
+
+	if report := readZipFile(t, archive, "_errors.txt"); !strings.Contains(report, "missing.txt") || !strings.Contains(report, "/missing") {
+		t.Fatalf("unexpected report: %s", report)
+	}
+}
+
+func TestSkipFailedFilesJsonReport(t *testing.T) {
+	_, archive, err := streamWithMissingFile(t, zipfly.StreamerOptions{OnError: zipfly.ErrorSkip, ErrorReport: "json"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if report := readZipFile(t, archive, "_errors.json"); !strings.Contains(report, `"path": "missing.txt"`) {
+		t.Fatalf("unexpected report: %s", report)
+	}
+}
+
+func TestOptionalFile(t *testing.T) {
+	s, _, err := streamWithMissingFile(t, zipfly.StreamerOptions{}, true)
+	if err != nil || len(s.Failed) != 1 {
+		t.Fatalf("optional file not skipped: %v", err)
+	}
+}
+
+func TestAbortOnFailedFile(t *testing.T) {
+	_, _, err := streamWithMissingFile(t, zipfly.StreamerOptions{}, false)
+	if err == nil {
+		t.Fatalf("failed file ignored")
+	}
+
+	if _, err := zipfly.NewZipStreamerWithOptions([]zipfly.File{{Url: "https://test.com", Filename: "a.txt"}}, zipfly.StreamerOptions{OnError: "retry"}); err == nil {
+		t.Fatalf("unknown policy accepted")
+	}
+}
+
+func TestFileFailingWhileStreaming(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "100")
+		w.Write([]byte("partial"))
+		w.(http.Flusher).Flush()
+		panic(http.ErrAbortHandler)
+	}))
+	defer upstream.Close()
+
+	files := []zipfly.File{{Url: upstream.URL, Filename: "cut.txt", Optional: true}}
+	s, err := zipfly.NewZipStreamerWithOptions(files, zipfly.StreamerOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := new(bytes.Buffer)
+	if err := s.StreamFiles(w); err != nil || len(s.Failed) != 1 {
+		t.Fatalf("file not skipped: %v", err)
+	}
+
+	r, err := zip.NewReader(bytes.NewReader(w.Bytes()), int64(w.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, f := range r.File {
+		if f.Name == "cut.txt" {
+			t.Fatalf("truncated file left in the archive")
+		}
+	}
+}
+
+func TestSpoolLimit(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		size, _ := strconv.Atoi(r.URL.Query().Get("size"))
+		w.Write(bytes.Repeat([]byte("a"), size))
+	}))
+	defer upstream.Close()
+
+	for _, limit := range []int{50, 5 << 20} {
+		files := []zipfly.File{
+			{Url: upstream.URL + "?size=" + strconv.Itoa(limit+1), Filename: "large.txt"},
+			{Url: upstream.URL + "?size=" + strconv.Itoa(limit), Filename: "fits.txt"},
+		}
+		s, err := zipfly.NewZipStreamerWithOptions(files, zipfly.StreamerOptions{OnError: zipfly.ErrorSkip, MaxSpoolBytes: int64(limit)})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		w := new(bytes.Buffer)
+		if err := s.StreamFiles(w); err != nil {
+			t.Fatalf("archive aborted by a file over the spool limit: %v", err)
+		}
+
+		if len(s.Failed) != 1 || s.Failed[0].Path != "large.txt" || !strings.Contains(s.Failed[0].Error, "too large") {
+			t.Fatalf("file over the spool limit of %d not left out: %+v", limit, s.Failed)
+		}
+
+		r, err := zip.NewReader(bytes.NewReader(w.Bytes()), int64(w.Len()))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if r.File[0].Name != "fits.txt" || r.File[0].UncompressedSize64 != uint64(limit) {
+			t.Fatalf("file at the spool limit of %d not added: %s", limit, r.File[0].Name)
+		}
+	}
+}
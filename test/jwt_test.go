@@ -0,0 +1,139 @@
+package testing
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+
+	zipfly "github.com/baptistejub/zipfly/zip_fly"
+)
+
+type tokenIssuer struct {
+	signer   jose.Signer
+	verifier *zipfly.TokenVerifier
+}
+
+func newTokenIssuer(t *testing.T) *tokenIssuer {
+	publicKey, privateKey, _ := ed25519.GenerateKey(rand.Reader)
+
+	jwks, _ := json.Marshal(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{{Key: publicKey, KeyID: "k1", Algorithm: string(jose.EdDSA)}}})
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	os.WriteFile(path, jwks, 0600)
+
+	verifier, err := zipfly.NewTokenVerifier(zipfly.JWTOptions{JWKSFile: path, Issuer: "platform"})
+	if err != nil {
+		t.Fatalf("couldn't load JWKS: %v", err)
+	}
+
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.EdDSA, Key: privateKey}, (&jose.SignerOptions{}).WithHeader("kid", "k1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &tokenIssuer{signer: signer, verifier: verifier}
+}
+
+func (i *tokenIssuer) token(t *testing.T, claims map[string]interface{}) string {
+	base := jwt.Claims{Issuer: "platform", Expiry: jwt.NewNumericDate(time.Now().Add(time.Minute))}
+	token, err := jwt.Signed(i.signer).Claims(base).Claims(claims).Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return token
+}
+
+func sha256Hex(content []byte) string {
+	digest := sha256.Sum256(content)
+	return hex.EncodeToString(digest[:])
+}
+
+func TestJWTGetRequest(t *testing.T) {
+	manifest := []byte(`{"filename":"manifest.zip","files":[{"url":"https://a.com/1","filename":"1.txt"},{"url":"https://a.com/2","filename":"2.txt"}]}`)
+	source := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(manifest)
+	}))
+	defer source.Close()
+
+	issuer := newTokenIssuer(t)
+	server := zipfly.NewServer("production", zipfly.ServerOptions{TokenVerifier: issuer.verifier})
+	encodedSource := base64.StdEncoding.EncodeToString([]byte(source.URL))
+
+	status := func(query string, claims map[string]interface{}) int {
+		req := httptest.NewRequest("GET", "/zip?source="+encodedSource+query, nil)
+		req.Header.Set("Authorization", "Bearer "+issuer.token(t, claims))
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	if code := status("", map[string]interface{}{"source": "https://other.com"}); code != http.StatusForbidden {
+		t.Fatalf("token for another source accepted: %v", code)
+	}
+
+	if code := status("", map[string]interface{}{"source": source.URL, "manifest_sha256": sha256Hex([]byte("other"))}); code != http.StatusForbidden {
+		t.Fatalf("token for another manifest accepted: %v", code)
+	}
+
+	if code := status("&filename=other.zip", map[string]interface{}{"source": source.URL, "filename": "allowed.zip"}); code != http.StatusForbidden {
+		t.Fatalf("token for another filename accepted: %v", code)
+	}
+
+	if code := status("", map[string]interface{}{"source": source.URL, "max_entries": 1}); code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("token entries limit not enforced: %v", code)
+	}
+
+	if code := status("", map[string]interface{}{}); code != http.StatusForbidden {
+		t.Fatalf("unrestricted token accepted: %v", code)
+	}
+}
+
+func TestJWTPostRequest(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("Hello, world!"))
+	}))
+	defer upstream.Close()
+
+	issuer := newTokenIssuer(t)
+	server := zipfly.NewServer("production", zipfly.ServerOptions{TokenVerifier: issuer.verifier})
+	body := []byte(`{"files":[{"url":"` + upstream.URL + `","filename":"1.txt"}]}`)
+
+	status := func(token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/zip?token="+token, bytes.NewReader(body))
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, req)
+		return w
+	}
+
+	w := status(issuer.token(t, map[string]interface{}{"manifest_sha256": sha256Hex(body), "filename": "allowed.zip"}))
+	if w.Code != http.StatusOK || w.Header().Get("Content-Disposition") != `attachment; filename="allowed.zip"` {
+		t.Fatalf("valid token rejected: %v %s", w.Code, w.Header().Get("Content-Disposition"))
+	}
+
+	if w := status(issuer.token(t, map[string]interface{}{"source": upstream.URL})); w.Code != http.StatusForbidden {
+		t.Fatalf("token without manifest hash accepted: %v", w.Code)
+	}
+
+	if w := status("invalid"); w.Code != http.StatusForbidden {
+		t.Fatalf("invalid token accepted: %v", w.Code)
+	}
+
+	expired := jwt.Claims{Issuer: "platform", Expiry: jwt.NewNumericDate(time.Now().Add(-time.Hour))}
+	token, _ := jwt.Signed(issuer.signer).Claims(expired).Claims(map[string]interface{}{"manifest_sha256": sha256Hex(body)}).Serialize()
+	if w := status(token); w.Code != http.StatusForbidden {
+		t.Fatalf("expired token accepted: %v", w.Code)
+	}
+}
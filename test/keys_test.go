@@ -0,0 +1,200 @@
+package testing
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	zipfly "github.com/baptistejub/zipfly/zip_fly"
+)
+
+func sign(message, secret string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(message))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Signed POST request whose body is rejected once the signature is validated
+func signedPostStatus(options zipfly.ServerOptions, kid, secret string) int {
+	return signedPostStatusWith(options, kid, func(message string) string { return sign(message, secret) })
+}
+
+func signedPostStatusWith(options zipfly.ServerOptions, kid string, signer func(message string) string) int {
+	body := []byte(`{"files":[]}`)
+	expires := strconv.FormatInt(time.Now().Add(time.Minute).Unix(), 10)
+	req := httptest.NewRequest("POST", "/zip", bytes.NewReader(body))
+	req.Header.Set("X-Zipfly-Expires", expires)
+	req.Header.Set("X-Zipfly-Signature", signer(expires+":"+string(body)))
+	if kid != "" {
+		req.Header.Set("X-Zipfly-Key-Id", kid)
+	}
+
+	w := httptest.NewRecorder()
+	zipfly.NewServer("production", options).ServeHTTP(w, req)
+
+	return w.Code
+}
+
+func TestSignatureWithKeyId(t *testing.T) {
+	keys, err := zipfly.NewKeySet(map[string]zipfly.SigningKey{
+		"old":    {Secret: "old-secret", NotAfter: time.Now().Add(-time.Hour)},
+		"new":    {Secret: "new-secret", NotBefore: time.Now().Add(-time.Hour)},
+		"future": {Secret: "future-secret", NotBefore: time.Now().Add(time.Hour)},
+	})
+	if err != nil {
+		t.Fatalf("invalid keys: %v", err)
+	}
+	options := zipfly.ServerOptions{SigningSecret: "secret", SigningKeys: keys}
+
+	if code := signedPostStatus(options, "new", "new-secret"); code != http.StatusBadRequest {
+		t.Fatalf("valid key rejected: %v", code)
+	}
+
+	if code := signedPostStatus(options, "", "secret"); code != http.StatusBadRequest {
+		t.Fatalf("signature without key id rejected: %v", code)
+	}
+
+	if code := signedPostStatus(options, "old", "old-secret"); code != http.StatusForbidden {
+		t.Fatalf("expired key accepted: %v", code)
+	}
+
+	if code := signedPostStatus(options, "future", "future-secret"); code != http.StatusForbidden {
+		t.Fatalf("not yet valid key accepted: %v", code)
+	}
+
+	if code := signedPostStatus(options, "new", "old-secret"); code != http.StatusForbidden {
+		t.Fatalf("invalid signature accepted: %v", code)
+	}
+
+	if code := signedPostStatus(options, "unknown", "new-secret"); code != http.StatusForbidden {
+		t.Fatalf("unknown key accepted: %v", code)
+	}
+}
+
+func TestKeySetReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.yml")
+	os.WriteFile(path, []byte("keys:\n  k1:\n    secret: secret1\n"), 0600)
+
+	keys, err := zipfly.LoadKeySet(path)
+	if err != nil {
+		t.Fatalf("couldn't load keys: %v", err)
+	}
+	options := zipfly.ServerOptions{SigningKeys: keys}
+
+	if code := signedPostStatus(options, "k1", "secret1"); code != http.StatusBadRequest {
+		t.Fatalf("valid key rejected: %v", code)
+	}
+
+	os.WriteFile(path, []byte("keys:\n  k2:\n    secret: secret2\n"), 0600)
+	if err := keys.Reload(); err != nil {
+		t.Fatalf("couldn't reload keys: %v", err)
+	}
+
+	if code := signedPostStatus(options, "k1", "secret1"); code != http.StatusForbidden {
+		t.Fatalf("removed key accepted: %v", code)
+	}
+
+	if code := signedPostStatus(options, "k2", "secret2"); code != http.StatusBadRequest {
+		t.Fatalf("reloaded key rejected: %v", code)
+	}
+
+	os.WriteFile(path, []byte("keys:\n  k3: {}\n"), 0600)
+	if err := keys.Reload(); err == nil {
+		t.Fatalf("invalid keys file loaded")
+	}
+
+	if code := signedPostStatus(options, "k2", "secret2"); code != http.StatusBadRequest {
+		t.Fatalf("keys not kept after invalid reload: %v", code)
+	}
+}
+
+func publicKeyPEM(t *testing.T, publicKey interface{}) string {
+	der, err := x509.MarshalPKIXPublicKey(publicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+}
+
+func TestAsymmetricSignatures(t *testing.T) {
+	edPublic, edPrivate, _ := ed25519.GenerateKey(rand.Reader)
+	ecPrivate, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	keys, err := zipfly.NewKeySet(map[string]zipfly.SigningKey{
+		"ed":   {PublicKey: publicKeyPEM(t, edPublic)},
+		"ec":   {PublicKey: publicKeyPEM(t, &ecPrivate.PublicKey)},
+		"hmac": {Secret: "secret"},
+	})
+	if err != nil {
+		t.Fatalf("invalid keys: %v", err)
+	}
+	options := zipfly.ServerOptions{SigningKeys: keys}
+
+	edSigner := func(message string) string {
+		return base64.RawURLEncoding.EncodeToString(ed25519.Sign(edPrivate, []byte(message)))
+	}
+	ecSigner := func(message string) string {
+		digest := sha256.Sum256([]byte(message))
+		signature, _ := ecdsa.SignASN1(rand.Reader, ecPrivate, digest[:])
+		return base64.RawURLEncoding.EncodeToString(signature)
+	}
+
+	if code := signedPostStatusWith(options, "ed", edSigner); code != http.StatusBadRequest {
+		t.Fatalf("valid Ed25519 signature rejected: %v", code)
+	}
+
+	if code := signedPostStatusWith(options, "ec", ecSigner); code != http.StatusBadRequest {
+		t.Fatalf("valid ECDSA signature rejected: %v", code)
+	}
+
+	if code := signedPostStatusWith(options, "ec", edSigner); code != http.StatusForbidden {
+		t.Fatalf("signature of another key accepted: %v", code)
+	}
+
+	if code := signedPostStatus(options, "ed", "secret"); code != http.StatusForbidden {
+		t.Fatalf("HMAC signature accepted for a public key: %v", code)
+	}
+}
+
+func TestInvalidPublicKey(t *testing.T) {
+	_, err := zipfly.NewKeySet(map[string]zipfly.SigningKey{"k": {PublicKey: "not a key"}})
+	if err == nil {
+		t.Fatalf("accepted invalid public key")
+	}
+
+	_, err = zipfly.NewKeySet(map[string]zipfly.SigningKey{"k": {PublicKey: "pem", Secret: "secret"}})
+	if err == nil {
+		t.Fatalf("accepted key with secret and public key")
+	}
+}
+
+func TestNewKeySetKeepsMap(t *testing.T) {
+	edPublic, _, _ := ed25519.GenerateKey(rand.Reader)
+	keys := map[string]zipfly.SigningKey{"ed": {PublicKey: publicKeyPEM(t, edPublic)}}
+	original := keys["ed"]
+
+	if _, err := zipfly.NewKeySet(keys); err != nil {
+		t.Fatalf("invalid keys: %v", err)
+	}
+
+	if !reflect.DeepEqual(keys["ed"], original) {
+		t.Fatalf("given keys modified")
+	}
+}
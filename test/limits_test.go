@@ -0,0 +1,74 @@
+package testing
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	zipfly "github.com/baptistejub/zipfly/zip_fly"
+)
+
+func limitsStatus(t *testing.T, limits zipfly.LimitsOptions, manifestFields string, files int) int {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("0123456789"))
+	}))
+	defer upstream.Close()
+
+	items := make([]string, files)
+	for i := range items {
+		items[i] = `{"url":"` + upstream.URL + `","filename":"file` + string(rune('a'+i)) + `.txt"}`
+	}
+	body := `{` + manifestFields + `"files":[` + strings.Join(items, ",") + `]}`
+
+	req := httptest.NewRequest("POST", "/zip", bytes.NewReader([]byte(body)))
+	w := httptest.NewRecorder()
+	zipfly.NewServer("test", zipfly.ServerOptions{Limits: limits}).ServeHTTP(w, req)
+
+	return w.Code
+}
+
+func TestSizeCheck(t *testing.T) {
+	if code := limitsStatus(t, zipfly.LimitsOptions{MaxEntryBytes: 5, SizeCheck: true}, "", 1); code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("file over the limit accepted: %v", code)
+	}
+
+	if code := limitsStatus(t, zipfly.LimitsOptions{SizeCheck: true}, `"max_bytes":15,`, 2); code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("archive over the manifest limit accepted: %v", code)
+	}
+
+	if code := limitsStatus(t, zipfly.LimitsOptions{MaxBytes: 15, SizeCheck: true}, `"max_bytes":100,`, 2); code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("manifest raised the server limit: %v", code)
+	}
+
+	if code := limitsStatus(t, zipfly.LimitsOptions{MaxBytes: 100, MaxEntryBytes: 10, SizeCheck: true}, "", 2); code != http.StatusOK {
+		t.Fatalf("archive within the limits rejected: %v", code)
+	}
+}
+
+func TestMaxEntries(t *testing.T) {
+	if code := limitsStatus(t, zipfly.LimitsOptions{MaxEntries: 1}, "", 2); code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("too many files accepted: %v", code)
+	}
+
+	if code := limitsStatus(t, zipfly.LimitsOptions{}, `"max_entries":1,`, 2); code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("too many files for the manifest accepted: %v", code)
+	}
+}
+
+func TestEntryMaxBytesWhileStreaming(t *testing.T) {
+	entries := []*zipfly.Entry{
+		{Url: "https://ignored.com", ZipPath: "exact.txt", ContentReader: io.NopCloser(strings.NewReader("0123456789")), MaxBytes: 10},
+		{Url: "https://ignored.com", ZipPath: "over.txt", ContentReader: io.NopCloser(strings.NewReader("0123456789")), MaxBytes: 5},
+	}
+
+	err := (&zipfly.ZipStreamer{Entries: entries}).StreamFiles(io.Discard)
+
+	var entryErr *zipfly.EntryError
+	if err == nil || !errors.As(err, &entryErr) || entryErr.Entry.ZipPath != "over.txt" {
+		t.Fatalf("file over the limit streamed: %v", err)
+	}
+}
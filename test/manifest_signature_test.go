@@ -0,0 +1,62 @@
+package testing
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	zipfly "github.com/baptistejub/zipfly/zip_fly"
+)
+
+func manifestStatus(options zipfly.ServerOptions, manifest string, params url.Values) int {
+	source := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(manifest))
+	}))
+	defer source.Close()
+
+	params.Set("source", base64.StdEncoding.EncodeToString([]byte(source.URL)))
+	req := httptest.NewRequest("GET", "/zip?"+params.Encode(), nil)
+	w := httptest.NewRecorder()
+	zipfly.NewServer("test", options).ServeHTTP(w, req)
+
+	return w.Code
+}
+
+func TestSignedManifest(t *testing.T) {
+	options := zipfly.ServerOptions{SigningSecret: "secret", RequireManifestSignature: true}
+
+	// canonical content: keys sorted, no whitespace, without the signature
+	signature := sign(`{"filename":"a&b.zip","files":[]}`, "secret")
+	manifest := `{ "filename": "a&b.zip", "signature": "` + signature + `", "files": [] }`
+
+	if code := manifestStatus(options, manifest, url.Values{}); code == http.StatusForbidden {
+		t.Fatalf("signed manifest rejected")
+	}
+
+	tampered := `{ "filename": "other.zip", "signature": "` + signature + `", "files": [] }`
+	if code := manifestStatus(options, tampered, url.Values{}); code != http.StatusForbidden {
+		t.Fatalf("tampered manifest accepted: %v", code)
+	}
+
+	if code := manifestStatus(options, `{"files":[]}`, url.Values{}); code != http.StatusForbidden {
+		t.Fatalf("unsigned manifest accepted: %v", code)
+	}
+}
+
+func TestPinnedManifest(t *testing.T) {
+	options := zipfly.ServerOptions{RequireManifestSignature: true}
+	manifest := `{"files":[]}`
+	digest := sha256.Sum256([]byte(manifest))
+
+	if code := manifestStatus(options, manifest, url.Values{"manifest_sha256": {hex.EncodeToString(digest[:])}}); code == http.StatusForbidden {
+		t.Fatalf("pinned manifest rejected")
+	}
+
+	if code := manifestStatus(options, `{"files":[{}]}`, url.Values{"manifest_sha256": {hex.EncodeToString(digest[:])}}); code != http.StatusForbidden {
+		t.Fatalf("manifest not matching its pin accepted: %v", code)
+	}
+}
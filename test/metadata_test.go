@@ -0,0 +1,118 @@
+package testing
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	zipfly "github.com/baptistejub/zipfly/zip_fly"
+)
+
+func TestEntryMetadata(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("#!/bin/sh"))
+	}))
+	defer upstream.Close()
+
+	uid, gid := 1000, 100
+	files := []zipfly.File{
+		{Url: upstream.URL, Filename: "bin/run.sh", Mode: "0755", Comment: "entry point", Uid: &uid, Gid: &gid},
+		{Type: zipfly.FileTypeSymlink, Filename: "run", Target: "bin/run.sh"},
+	}
+
+	s, err := zipfly.NewZipStreamerWithOptions(files, zipfly.StreamerOptions{Comment: "build 42"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := new(bytes.Buffer)
+	if err := s.StreamFiles(w); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := zip.NewReader(bytes.NewReader(w.Bytes()), int64(w.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if r.Comment != "build 42" {
+		t.Fatalf("unexpected archive comment %q", r.Comment)
+	}
+
+	script := r.File[0]
+	if script.Mode() != 0o755 || script.Comment != "entry point" {
+		t.Fatalf("unexpected script mode %v or comment %q", script.Mode(), script.Comment)
+	}
+
+	owner := false
+	for extra := script.Extra; len(extra) >= 4; {
+		id, size := binary.LittleEndian.Uint16(extra), int(binary.LittleEndian.Uint16(extra[2:]))
+		if id == 0x7875 {
+			owner = binary.LittleEndian.Uint32(extra[6:]) == 1000 && binary.LittleEndian.Uint32(extra[11:]) == 100
+		}
+		extra = extra[4+size:]
+	}
+	if !owner {
+		t.Fatalf("missing uid and gid")
+	}
+
+	link := r.File[1]
+	target, _ := link.Open()
+	defer target.Close()
+	if content, _ := io.ReadAll(target); link.Mode()&os.ModeSymlink == 0 || string(content) != "bin/run.sh" {
+		t.Fatalf("invalid symlink: %v %s", link.Mode(), content)
+	}
+}
+
+func TestInvalidEntryMetadata(t *testing.T) {
+	invalid := []zipfly.File{
+		{Url: "https://test.com", Filename: "a.sh", Mode: "0999"},
+		{Url: "https://test.com", Filename: "a.sh", Mode: "4755"},
+		{Url: "https://test.com", Filename: "a", Type: "fifo"},
+		{Type: zipfly.FileTypeSymlink, Filename: "a", Target: "/etc/passwd"},
+		{Type: zipfly.FileTypeSymlink, Filename: "dir/a", Target: "../../b"},
+		{Type: zipfly.FileTypeSymlink, Filename: "a"},
+		{Type: zipfly.FileTypeSymlink, Url: "https://test.com", Filename: "a", Target: "b"},
+	}
+
+	for _, file := range invalid {
+		if _, err := zipfly.NewZipStreamer([]zipfly.File{file}); err == nil {
+			t.Errorf("invalid file accepted: %+v", file)
+		}
+	}
+}
+
+func TestChainedSymlinks(t *testing.T) {
+	link := func(filename, target string) zipfly.File {
+		return zipfly.File{Type: zipfly.FileTypeSymlink, Filename: filename, Target: target}
+	}
+
+	escaping := [][]zipfly.File{
+		// written through the first link, l2 points two levels above the archive
+		{link("d1/d2/l", "../.."), link("d1/d2/l/l2", "../..")},
+		// the ".." after the link applies to its target, the archive root
+		{link("d1/d2/l", "../.."), link("m", "d1/d2/l/../..")},
+		{link("a", "b"), link("b", "a")},
+	}
+
+	for _, files := range escaping {
+		if _, err := zipfly.NewZipStreamer(files); err == nil {
+			t.Errorf("escaping symlinks accepted: %+v", files)
+		}
+	}
+
+	files := []zipfly.File{
+		{Url: "https://test.com", Filename: "bin/run.sh"},
+		link("lib/run", "../bin/run.sh"),
+		link("d1/d2/l", "../.."),
+		link("current", "d1/d2/l/lib"),
+	}
+	if _, err := zipfly.NewZipStreamer(files); err != nil {
+		t.Fatalf("valid symlinks rejected: %v", err)
+	}
+}
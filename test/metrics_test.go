@@ -0,0 +1,46 @@
+package testing
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	zipfly "github.com/baptistejub/zipfly/zip_fly"
+)
+
+func TestTenantMetrics(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("Hello, world!"))
+	}))
+	defer upstream.Close()
+
+	server := zipfly.NewServer("test", zipfly.ServerOptions{Tenants: map[string]*zipfly.Tenant{"acme": {}}})
+	noop := func(req *http.Request) {}
+
+	if code := tenantPostStatus(server, "/t/acme/zip", `{"files":[{"url":"`+upstream.URL+`","filename":"a.txt"}]}`, noop); code != http.StatusOK {
+		t.Fatalf("tenant archive failed: %v", code)
+	}
+
+	if code := tenantPostStatus(server, "/zip", `{"files":[{"url":"`+upstream.URL+`","filename":"../a.txt"}]}`, noop); code != http.StatusBadRequest {
+		t.Fatalf("invalid archive accepted: %v", code)
+	}
+
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	metrics := w.Body.String()
+
+	for _, line := range []string{
+		`zipfly_archives_active{tenant="acme"} 0`,
+		`zipfly_archives_total{tenant="acme",result="done"} 1`,
+		`zipfly_archives_total{tenant="",result="failed"} 1`,
+	} {
+		if !strings.Contains(metrics, line+"\n") {
+			t.Fatalf("missing %s in metrics: %s", line, metrics)
+		}
+	}
+
+	if strings.Contains(metrics, `zipfly_archive_bytes_total{tenant="acme"} 0`) {
+		t.Fatalf("tenant bytes not counted: %s", metrics)
+	}
+}
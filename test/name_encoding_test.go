@@ -0,0 +1,107 @@
+package testing
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"testing"
+
+	zipfly "github.com/baptistejub/zipfly/zip_fly"
+)
+
+func encodedHeader(t *testing.T, encoding zipfly.NameEncoding, filename string) *zip.File {
+	entries := []*zipfly.Entry{{Url: "https://ignored.com", ZipPath: filename, ContentReader: content}}
+	s := zipfly.ZipStreamer{Entries: entries, NameEncoding: encoding}
+
+	w := new(bytes.Buffer)
+	if err := s.StreamFiles(w); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := zip.NewReader(bytes.NewReader(w.Bytes()), int64(w.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return r.File[0]
+}
+
+func TestLegacyNameEncodings(t *testing.T) {
+	expected := []struct {
+		encoding zipfly.NameEncoding
+		filename string
+		header   string
+	}{
+		{zipfly.NameCP437, "café/ß.txt", "caf\x82/\xe1.txt"},
+		{zipfly.NameShiftJIS, "日本/ア.txt", "\x93\xfa\x96\x7b/\x83\x41.txt"},
+		{zipfly.NameGBK, "中文.txt", "\xd6\xd0\xce\xc4.txt"},
+	}
+
+	// 0x800 is the UTF-8 flag
+	for _, e := range expected {
+		file := encodedHeader(t, e.encoding, e.filename)
+		if file.Name != e.header || file.Flags&0x800 != 0 {
+			t.Errorf("%s %q: got %q, expected %q", e.encoding, e.filename, file.Name, e.header)
+		}
+	}
+
+	if file := encodedHeader(t, "", "café.txt"); file.Name != "café.txt" || file.Flags&0x800 == 0 {
+		t.Errorf("UTF-8 name changed: %q", file.Name)
+	}
+}
+
+func TestUnicodePathExtra(t *testing.T) {
+	file := encodedHeader(t, zipfly.NameUtf8UnicodePathExtra, "café.txt")
+	if file.Name != "caf\x82.txt" {
+		t.Fatalf("unexpected header name %q", file.Name)
+	}
+
+	for extra := file.Extra; len(extra) >= 4; {
+		id, size := binary.LittleEndian.Uint16(extra), int(binary.LittleEndian.Uint16(extra[2:]))
+		data := extra[4 : 4+size]
+		extra = extra[4+size:]
+
+		if id != 0x7075 {
+			continue
+		}
+
+		if data[0] != 1 || binary.LittleEndian.Uint32(data[1:]) != crc32.ChecksumIEEE([]byte(file.Name)) || string(data[5:]) != "café.txt" {
+			t.Fatalf("invalid unicode path extra field: %v", data)
+		}
+		return
+	}
+
+	t.Fatalf("no unicode path extra field")
+}
+
+func TestUnencodableNames(t *testing.T) {
+	rejected := []struct {
+		encoding zipfly.NameEncoding
+		filename string
+	}{
+		{zipfly.NameCP437, "日本.txt"},
+		// 0x83 0x5C, the trail byte is a backslash
+		{zipfly.NameShiftJIS, "ソ.txt"},
+	}
+
+	for _, r := range rejected {
+		files := []zipfly.File{{Url: "https://a.com/1", Filename: r.filename}}
+		if _, err := zipfly.NewZipStreamerWithOptions(files, zipfly.StreamerOptions{NameEncoding: r.encoding}); err == nil {
+			t.Errorf("%s %q accepted", r.encoding, r.filename)
+		}
+	}
+}
+
+func TestUnicodePathExtraDuplicates(t *testing.T) {
+	files := []zipfly.File{{Url: "https://a.com/1", Filename: "日本.txt"}, {Url: "https://a.com/2", Filename: "中国.txt"}}
+	s, err := zipfly.NewZipStreamerWithOptions(files, zipfly.StreamerOptions{NameEncoding: zipfly.NameUtf8UnicodePathExtra})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// both are __.txt in CP437
+	if s.Entries[1].ZipPath != "中国 (1).txt" {
+		t.Fatalf("duplicate code page name kept: %q", s.Entries[1].ZipPath)
+	}
+}
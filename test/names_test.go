@@ -0,0 +1,74 @@
+package testing
+
+import (
+	"strings"
+	"testing"
+
+	zipfly "github.com/baptistejub/zipfly/zip_fly"
+)
+
+func sanitizedPath(policy zipfly.NamePolicy, filename string) (string, error) {
+	s, err := zipfly.NewZipStreamerWithOptions([]zipfly.File{{Url: "https://test.com", Filename: filename}}, zipfly.StreamerOptions{NamePolicy: policy})
+	if err != nil {
+		return "", err
+	}
+
+	return s.Entries[0].ZipPath, nil
+}
+
+func TestWindowsSafeNames(t *testing.T) {
+	cases := map[string]string{
+		"CON.txt":                         "_CON.txt",
+		"dir/lpt1":                        "dir/_lpt1",
+		"a:b.pdf":                         "a_b.pdf",
+		"report. ":                        "report",
+		"dir\\sub\\file.txt":              "dir/sub/file.txt",
+		"tab\there.txt":                   "tab_here.txt",
+		"what?.txt":                       "what_.txt",
+		"e\u0301te\u0301.txt":             "\u00e9t\u00e9.txt",
+		"folder./file.txt":                "folder/file.txt",
+		"console.txt":                     "console.txt",
+		strings.Repeat("a", 300):          strings.Repeat("a", 255),
+		strings.Repeat("é", 200) + ".jpg": strings.Repeat("é", 125) + ".jpg",
+	}
+
+	for filename, expected := range cases {
+		sanitized, err := sanitizedPath(zipfly.NameWindowsSafe, filename)
+		if err != nil || sanitized != expected {
+			t.Errorf("%q sanitized to %q (%v), expected %q", filename, sanitized, err, expected)
+		}
+	}
+}
+
+func TestStrictNames(t *testing.T) {
+	for _, filename := range []string{"CON.txt", "a:b.pdf", "report.", "dir\\file.txt", strings.Repeat("a", 300)} {
+		if _, err := sanitizedPath(zipfly.NameStrict, filename); err == nil {
+			t.Errorf("%q accepted", filename)
+		}
+	}
+
+	if sanitized, err := sanitizedPath(zipfly.NameStrict, "e\u0301.txt"); err != nil || sanitized != "\u00e9.txt" {
+		t.Errorf("valid name rejected or not normalized: %q %v", sanitized, err)
+	}
+
+	if sanitized, err := sanitizedPath(zipfly.NamePassthrough, "a:b.pdf"); err != nil || sanitized != "a:b.pdf" {
+		t.Errorf("passthrough name changed: %q %v", sanitized, err)
+	}
+
+	// like the zipfly binary
+	if sanitized, err := sanitizedPath("", "a:b.pdf"); err != nil || sanitized != "a_b.pdf" {
+		t.Errorf("default policy isn't windows: %q %v", sanitized, err)
+	}
+}
+
+func TestRenamedEntries(t *testing.T) {
+	files := []zipfly.File{{Url: "https://test.com", Filename: "/ok.txt"}, {Url: "https://test.com", Filename: "a|b.txt"}}
+	s, err := zipfly.NewZipStreamerWithOptions(files, zipfly.StreamerOptions{NamePolicy: zipfly.NameWindowsSafe})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(s.Renamed) != 1 || s.Renamed[0] != (zipfly.NameChange{Original: "a|b.txt", Sanitized: "a_b.txt"}) {
+		t.Fatalf("invalid renamed report: %+v", s.Renamed)
+	}
+}
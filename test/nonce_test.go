@@ -0,0 +1,78 @@
+package testing
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	zipfly "github.com/baptistejub/zipfly/zip_fly"
+)
+
+func TestMemoryNonceStore(t *testing.T) {
+	store := zipfly.NewMemoryNonceStore()
+	expiresAt := time.Now().Add(time.Minute)
+
+	for i := 0; i < 2; i++ {
+		if ok, _ := store.Use("n1", 2, expiresAt); !ok {
+			t.Fatalf("use %d rejected", i+1)
+		}
+	}
+
+	if ok, _ := store.Use("n1", 2, expiresAt); ok {
+		t.Fatalf("third use accepted")
+	}
+
+	if ok, _ := store.Use("n2", 1, expiresAt); !ok {
+		t.Fatalf("other nonce rejected")
+	}
+}
+
+func TestBoltNonceStorePersistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "nonces.db")
+	expiresAt := time.Now().Add(time.Minute)
+
+	store, err := zipfly.OpenBoltNonceStore(path)
+	if err != nil {
+		t.Fatalf("couldn't open store: %v", err)
+	}
+
+	if ok, err := store.Use("n1", 1, expiresAt); !ok || err != nil {
+		t.Fatalf("first use rejected: %v", err)
+	}
+	store.Close()
+
+	store, err = zipfly.OpenBoltNonceStore(path)
+	if err != nil {
+		t.Fatalf("couldn't reopen store: %v", err)
+	}
+	defer store.Close()
+
+	if ok, _ := store.Use("n1", 1, expiresAt); ok {
+		t.Fatalf("nonce reused after restart")
+	}
+}
+
+func TestSingleUseLink(t *testing.T) {
+	server := zipfly.NewServer("test", zipfly.ServerOptions{})
+	body := []byte(`{"nonce":"n1","files":[]}`)
+
+	status := func() int {
+		req := httptest.NewRequest("POST", "/zip", bytes.NewReader(body))
+		req.Header.Set("X-Zipfly-Expires", strconv.FormatInt(time.Now().Add(time.Minute).Unix(), 10))
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	if code := status(); code != http.StatusBadRequest {
+		t.Fatalf("first use rejected: %v", code)
+	}
+
+	if code := status(); code != http.StatusGone {
+		t.Fatalf("second use accepted: %v", code)
+	}
+}
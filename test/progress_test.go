@@ -0,0 +1,143 @@
+package testing
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	zipfly "github.com/baptistejub/zipfly/zip_fly"
+)
+
+const testStreamId = "0123456789abcdef0123"
+
+func readServerSentEvents(body io.Reader) []string {
+	events := make([]string, 0)
+	scanner := bufio.NewScanner(body)
+	for scanner.Scan() {
+		if eventType, ok := strings.CutPrefix(scanner.Text(), "event: "); ok && eventType != "progress" {
+			events = append(events, eventType)
+		}
+	}
+
+	return events
+}
+
+func TestStreamEvents(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte("Hello, world!"))
+	}))
+	defer upstream.Close()
+
+	server := httptest.NewServer(zipfly.NewServer("test", zipfly.ServerOptions{}))
+	defer server.Close()
+
+	body := []byte(`{"files":[{"url":"` + upstream.URL + `/1","filename":"1.txt"},{"url":"` + upstream.URL + `/missing","filename":"2.txt"}]}`)
+	req, _ := http.NewRequest("POST", server.URL+"/zip", bytes.NewReader(body))
+	req.Header.Set("X-Zipfly-Stream-Id", testStreamId)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("zip request failed: %v", err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	if resp.Header.Get("X-Zipfly-Stream-Id") != testStreamId {
+		t.Fatalf("invalid stream id: %s", resp.Header.Get("X-Zipfly-Stream-Id"))
+	}
+
+	resp, err = http.Get(server.URL + "/zip/" + testStreamId + "/events")
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("events request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	events := readServerSentEvents(resp.Body)
+	expected := []string{"start", "entry_start", "entry_done", "entry_start", "error"}
+	if strings.Join(events, ",") != strings.Join(expected, ",") {
+		t.Fatalf("invalid events: %v", events)
+	}
+}
+
+func TestStreamEventsUnknownStream(t *testing.T) {
+	req := httptest.NewRequest("GET", "/zip/unknown/events", nil)
+	w := httptest.NewRecorder()
+
+	zipfly.NewServer("test", zipfly.ServerOptions{}).ServeHTTP(w, req)
+
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("invalid status: %v", w.Code)
+	}
+}
+
+func TestStreamEventsRetention(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte("a"))
+	}))
+	defer upstream.Close()
+
+	server := httptest.NewServer(zipfly.NewServer("test", zipfly.ServerOptions{}))
+	defer server.Close()
+
+	files := make([]string, 0, 600)
+	for i := 0; i < 600; i++ {
+		files = append(files, `{"url":"`+upstream.URL+`/`+strconv.Itoa(i)+`","filename":"`+strconv.Itoa(i)+`.txt"}`)
+	}
+	files = append(files, `{"url":"`+upstream.URL+`/missing?token=s3cret","filename":"missing.txt"}`)
+
+	req, _ := http.NewRequest("POST", server.URL+"/zip", bytes.NewReader([]byte(`{"files":[`+strings.Join(files, ",")+`]}`)))
+	req.Header.Set("X-Zipfly-Stream-Id", testStreamId)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("zip request failed: %v", err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	resp, err = http.Get(server.URL + "/zip/" + testStreamId + "/events")
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("events request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	raw, _ := io.ReadAll(resp.Body)
+	events := readServerSentEvents(bytes.NewReader(raw))
+	if len(events) > 1000 || events[0] == "start" || events[len(events)-1] != "error" {
+		t.Fatalf("events not capped: %d events, from %s to %s", len(events), events[0], events[len(events)-1])
+	}
+
+	if bytes.Contains(raw, []byte("s3cret")) || bytes.Contains(raw, []byte(upstream.URL)) {
+		t.Fatalf("source URL in the events")
+	}
+}
+
+func TestStreamEventsRateLimit(t *testing.T) {
+	server := zipfly.NewServer("test", zipfly.ServerOptions{RateLimit: zipfly.RateLimitOptions{RequestsPerSecond: 0.5}})
+	get := func() int {
+		req := httptest.NewRequest("GET", "/zip/unknown/events", nil)
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, req)
+
+		return w.Code
+	}
+
+	if code := get(); code != http.StatusNotFound {
+		t.Fatalf("first request rejected: %v", code)
+	}
+
+	if code := get(); code != http.StatusTooManyRequests {
+		t.Fatalf("events requests not limited: %v", code)
+	}
+}
@@ -0,0 +1,139 @@
+package testing
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	zipfly "github.com/baptistejub/zipfly/zip_fly"
+)
+
+func postFrom(server *zipfly.Server, ip, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", "/zip", bytes.NewReader([]byte(body)))
+	req.RemoteAddr = ip + ":1234"
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, req)
+
+	return w
+}
+
+func TestRequestsPerSecond(t *testing.T) {
+	server := zipfly.NewServer("test", zipfly.ServerOptions{RateLimit: zipfly.RateLimitOptions{RequestsPerSecond: 0.5, Burst: 2}})
+
+	for i := 0; i < 2; i++ {
+		if w := postFrom(server, "10.0.0.1", `{"files":[]}`); w.Code != http.StatusBadRequest {
+			t.Fatalf("request %d within the burst rejected: %v", i, w.Code)
+		}
+	}
+
+	w := postFrom(server, "10.0.0.1", `{"files":[]}`)
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "2" {
+		t.Fatalf("request over the limit accepted: %v, Retry-After %q", w.Code, w.Header().Get("Retry-After"))
+	}
+
+	if w := postFrom(server, "10.0.0.2", `{"files":[]}`); w.Code != http.StatusBadRequest {
+		t.Fatalf("other client limited: %v", w.Code)
+	}
+}
+
+func TestConcurrentStreams(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+		w.Write([]byte("content"))
+	}))
+	defer upstream.Close()
+
+	server := zipfly.NewServer("test", zipfly.ServerOptions{RateLimit: zipfly.RateLimitOptions{ConcurrentStreams: 1}})
+	body := `{"files":[{"url":"` + upstream.URL + `","filename":"a.txt"}]}`
+
+	done := make(chan int)
+	go func() { done <- postFrom(server, "10.0.0.1", body).Code }()
+	<-started
+
+	if w := postFrom(server, "10.0.0.1", body); w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Fatalf("second concurrent stream accepted: %v", w.Code)
+	}
+
+	close(release)
+	if code := <-done; code != http.StatusOK {
+		t.Fatalf("first stream failed: %v", code)
+	}
+
+	go func() { <-started }()
+	if w := postFrom(server, "10.0.0.1", body); w.Code != http.StatusOK {
+		t.Fatalf("stream slot not released: %v", w.Code)
+	}
+}
+
+func TestClientIPHeader(t *testing.T) {
+	server := zipfly.NewServer("test", zipfly.ServerOptions{RateLimit: zipfly.RateLimitOptions{RequestsPerSecond: 0.5, ClientIPHeader: "X-Forwarded-For"}})
+	forwardedPost := func(forwarded string) int {
+		req := httptest.NewRequest("POST", "/zip", bytes.NewReader([]byte(`{"files":[]}`)))
+		req.Header.Set("X-Forwarded-For", forwarded)
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, req)
+
+		return w.Code
+	}
+
+	if code := forwardedPost("1.1.1.1, 10.0.0.1"); code != http.StatusBadRequest {
+		t.Fatalf("first request rejected: %v", code)
+	}
+
+	// the client can only prepend addresses
+	if code := forwardedPost("2.2.2.2, 10.0.0.1"); code != http.StatusTooManyRequests {
+		t.Fatalf("spoofed address used: %v", code)
+	}
+}
+
+func TestRateLimitByKey(t *testing.T) {
+	keys, _ := zipfly.NewKeySet(map[string]zipfly.SigningKey{"a": {Secret: "a-secret"}})
+	server := zipfly.NewServer("production", zipfly.ServerOptions{
+		SigningKeys: keys,
+		RateLimit:   zipfly.RateLimitOptions{RequestsPerSecond: 0.5, By: "key"},
+	})
+	post := func(ip, secret string) int {
+		return signedPostFrom(server, ip, "a", secret, `{"files":[]}`)
+	}
+
+	// a forged signature doesn't spend the limit of the key
+	if code := post("10.0.0.1", "wrong"); code != http.StatusForbidden {
+		t.Fatalf("forged signature accepted: %v", code)
+	}
+	if code := post("10.0.0.1", "wrong"); code != http.StatusTooManyRequests {
+		t.Fatalf("unauthenticated requests not limited by IP: %v", code)
+	}
+
+	if code := post("10.0.0.2", "a-secret"); code != http.StatusBadRequest {
+		t.Fatalf("signed request rejected: %v", code)
+	}
+	if code := post("10.0.0.3", "a-secret"); code != http.StatusTooManyRequests {
+		t.Fatalf("key not limited across IPs: %v", code)
+	}
+
+	// not read before the rate limit, so limited by IP, and given whole to the handler
+	large := `{"files":[]` + strings.Repeat(" ", 2<<20) + `}`
+	if code := signedPostFrom(server, "10.0.0.4", "a", "a-secret", large); code != http.StatusBadRequest {
+		t.Fatalf("large signed request rejected: %v", code)
+	}
+}
+
+func signedPostFrom(server *zipfly.Server, ip, kid, secret, body string) int {
+	expires := strconv.FormatInt(time.Now().Add(time.Minute).Unix(), 10)
+	req := httptest.NewRequest("POST", "/zip", strings.NewReader(body))
+	req.RemoteAddr = ip + ":1234"
+	req.Header.Set("X-Zipfly-Expires", expires)
+	req.Header.Set("X-Zipfly-Key-Id", kid)
+	req.Header.Set("X-Zipfly-Signature", sign(expires+":"+body, secret))
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, req)
+
+	return w.Code
+}
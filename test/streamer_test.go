@@ -64,3 +64,31 @@ func TestStreamFilesInvalid(t *testing.T) {
 		t.Fatalf("streamed invalid zip")
 	}
 }
+
+func TestStreamFilesProgress(t *testing.T) {
+	entries := []*zipfly.Entry{
+		{Url: "https://ignored.com", ZipPath: "test.txt", ContentReader: io.NopCloser(strings.NewReader("Hello, world!"))},
+		{Url: "https://ignored.com", ZipPath: "test2.txt", ContentReader: io.NopCloser(strings.NewReader("Hello!"))},
+	}
+
+	events := make([]zipfly.ProgressEvent, 0)
+	s := zipfly.ZipStreamer{Entries: entries, OnProgress: func(e zipfly.ProgressEvent) { events = append(events, e) }}
+
+	w := new(bytes.Buffer)
+
+	if err := s.StreamFiles(w); err != nil {
+		t.Fatalf("streaming error: %v", err)
+	}
+
+	if len(events) != 4 {
+		t.Fatalf("invalid events count: %v", len(events))
+	}
+
+	if events[0].Done || events[0].Index != 0 || !events[1].Done || events[1].EntryBytes != 13 {
+		t.Fatalf("invalid first entry events: %+v", events[:2])
+	}
+
+	if events[3].Index != 1 || events[3].EntryBytes != 6 || events[3].ArchiveBytes == 0 {
+		t.Fatalf("invalid last entry event: %+v", events[3])
+	}
+}
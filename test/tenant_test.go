@@ -0,0 +1,192 @@
+package testing
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	zipfly "github.com/baptistejub/zipfly/zip_fly"
+)
+
+func tenantPostStatus(server *zipfly.Server, target, body string, prepare func(req *http.Request)) int {
+	expires := strconv.FormatInt(time.Now().Add(time.Minute).Unix(), 10)
+	req := httptest.NewRequest("POST", target, bytes.NewReader([]byte(body)))
+	req.Header.Set("X-Zipfly-Expires", expires)
+	prepare(req)
+
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, req)
+
+	return w.Code
+}
+
+func TestTenantSigningKeys(t *testing.T) {
+	server := zipfly.NewServer("production", zipfly.ServerOptions{
+		SigningSecret: "global-secret",
+		Tenants:       map[string]*zipfly.Tenant{"acme": {SigningSecret: "acme-secret"}},
+	})
+	body := `{"files":[]}`
+	signWith := func(secret string) func(req *http.Request) {
+		return func(req *http.Request) {
+			req.Header.Set("X-Zipfly-Signature", sign(req.Header.Get("X-Zipfly-Expires")+":"+body, secret))
+		}
+	}
+
+	if code := tenantPostStatus(server, "/t/acme/zip", body, signWith("acme-secret")); code != http.StatusBadRequest {
+		t.Fatalf("tenant signature rejected: %v", code)
+	}
+
+	if code := tenantPostStatus(server, "/t/acme/zip", body, signWith("global-secret")); code != http.StatusForbidden {
+		t.Fatalf("global secret accepted for the tenant: %v", code)
+	}
+
+	if code := tenantPostStatus(server, "/zip", body, signWith("acme-secret")); code != http.StatusForbidden {
+		t.Fatalf("tenant secret accepted without tenant: %v", code)
+	}
+
+	byHeader := func(req *http.Request) {
+		signWith("acme-secret")(req)
+		req.Header.Set("X-Zipfly-Tenant", "acme")
+	}
+	if code := tenantPostStatus(server, "/zip", body, byHeader); code != http.StatusBadRequest {
+		t.Fatalf("tenant header ignored: %v", code)
+	}
+
+	bySubdomain := func(req *http.Request) {
+		signWith("acme-secret")(req)
+		req.Host = "acme.zip.example.com"
+	}
+	if code := tenantPostStatus(server, "/zip", body, bySubdomain); code != http.StatusBadRequest {
+		t.Fatalf("tenant subdomain ignored: %v", code)
+	}
+
+	if code := tenantPostStatus(server, "/t/unknown/zip", body, signWith("acme-secret")); code != http.StatusNotFound {
+		t.Fatalf("unknown tenant accepted: %v", code)
+	}
+}
+
+func TestTenantAllowedHosts(t *testing.T) {
+	server := zipfly.NewServer("test", zipfly.ServerOptions{
+		Tenants: map[string]*zipfly.Tenant{"acme": {AllowedHosts: []string{"*.example.com"}}},
+	})
+	noop := func(req *http.Request) {}
+
+	if code := tenantPostStatus(server, "/t/acme/zip", `{"files":[{"url":"https://evil.com/a","filename":"a"}]}`, noop); code != http.StatusForbidden {
+		t.Fatalf("file on a forbidden host accepted: %v", code)
+	}
+
+	// rejected afterwards for its invalid path
+	if code := tenantPostStatus(server, "/t/acme/zip", `{"files":[{"url":"https://files.example.com/a","filename":"../a"}]}`, noop); code != http.StatusBadRequest {
+		t.Fatalf("file on an allowed host rejected: %v", code)
+	}
+}
+
+func TestTenantRedirects(t *testing.T) {
+	var forbiddenHits atomic.Int32
+	forbidden := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forbiddenHits.Add(1)
+		w.Write([]byte("secret"))
+	}))
+	defer forbidden.Close()
+
+	// the redirect goes to localhost instead of the allowed 127.0.0.1
+	redirecting := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, strings.Replace(forbidden.URL, "127.0.0.1", "localhost", 1), http.StatusFound)
+	}))
+	defer redirecting.Close()
+
+	server := zipfly.NewServer("test", zipfly.ServerOptions{
+		Tenants: map[string]*zipfly.Tenant{"acme": {AllowedHosts: []string{"127.0.0.1"}}},
+	})
+	noop := func(req *http.Request) {}
+
+	tenantPostStatus(server, "/t/acme/zip", `{"files":[{"url":"`+redirecting.URL+`/a","filename":"a"}]}`, noop)
+	if forbiddenHits.Load() != 0 {
+		t.Fatal("redirect to a forbidden host followed")
+	}
+
+	body := `{"callback_url":"https://evil.com/hook","files":[{"url":"` + redirecting.URL + `/a","filename":"a"}]}`
+	if code := tenantPostStatus(server, "/t/acme/zip", body, noop); code != http.StatusForbidden {
+		t.Fatalf("callback on a forbidden host accepted: %v", code)
+	}
+}
+
+func TestTokenTenant(t *testing.T) {
+	var forbiddenHits atomic.Int32
+	forbidden := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forbiddenHits.Add(1)
+		w.Write([]byte("secret"))
+	}))
+	defer forbidden.Close()
+
+	redirecting := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, strings.Replace(forbidden.URL, "127.0.0.1", "localhost", 1), http.StatusFound)
+	}))
+	defer redirecting.Close()
+
+	issuer := newTokenIssuer(t)
+	server := zipfly.NewServer("test", zipfly.ServerOptions{
+		TokenVerifier: issuer.verifier,
+		RateLimit:     zipfly.RateLimitOptions{RequestsPerSecond: 0.01, Burst: 1, By: "tenant"},
+		Tenants: map[string]*zipfly.Tenant{
+			"acme": {AllowedHosts: []string{"127.0.0.1"}, CorsAllowedOrigins: []string{"https://acme.example.com"}},
+			"beta": {},
+		},
+	})
+
+	post := func(tenant, origin string) *httptest.ResponseRecorder {
+		body := []byte(`{"files":[{"url":"` + redirecting.URL + `/a","filename":"a"}]}`)
+		req := httptest.NewRequest("POST", "/zip", bytes.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+issuer.token(t, map[string]interface{}{"manifest_sha256": sha256Hex(body), "tenant": tenant}))
+		req.Header.Set("Origin", origin)
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, req)
+		return w
+	}
+
+	w := post("acme", "https://other.example.com")
+	if forbiddenHits.Load() != 0 {
+		t.Fatal("redirect to a host forbidden for the token tenant followed")
+	}
+
+	if origin := w.Header().Get("Access-Control-Allow-Origin"); origin != "" {
+		t.Fatalf("origin allowed by the global policy instead of the token tenant one: %q", origin)
+	}
+
+	// each token tenant has its own bucket
+	if w := post("beta", "https://other.example.com"); w.Code == http.StatusTooManyRequests {
+		t.Fatal("token tenants share their rate limit")
+	}
+
+	if w := post("acme", "https://acme.example.com"); w.Code != http.StatusTooManyRequests {
+		t.Fatalf("token tenant rate limit not enforced: %v", w.Code)
+	}
+}
+
+func TestTenantConfig(t *testing.T) {
+	path := writeConfigFile(t, "tenants:\n  acme:\n    signing_secret: s3cret\n    max_entries: 10\n    allowed_hosts: [files.example.com]\n  Bad_Name:\n    max_bytes: -1\n")
+
+	c, err := zipfly.LoadConfig("test", []string{"-config", path, "-public-url", "http://localhost"})
+	if err != nil {
+		t.Fatalf("couldn't load config: %v", err)
+	}
+
+	if c.Tenants["acme"].MaxEntries != 10 || c.Tenants["acme"].AllowedHosts[0] != "files.example.com" {
+		t.Fatalf("tenant not loaded: %+v", c.Tenants)
+	}
+
+	err = c.Validate()
+	if err == nil || !strings.Contains(err.Error(), "tenants.Bad_Name:") || !strings.Contains(err.Error(), "tenants.Bad_Name.max_bytes") {
+		t.Fatalf("invalid tenant accepted: %v", err)
+	}
+
+	var out bytes.Buffer
+	if err := c.Print(&out); err != nil || strings.Contains(out.String(), "s3cret") {
+		t.Fatalf("tenant secret not masked: %s", out.String())
+	}
+}
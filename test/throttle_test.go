@@ -0,0 +1,56 @@
+package testing
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	zipfly "github.com/baptistejub/zipfly/zip_fly"
+)
+
+// Streams a 64 KiB file and returns how long it took
+func throttledDuration(t *testing.T, bandwidth zipfly.BandwidthOptions, manifestFields string) time.Duration {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(bytes.Repeat([]byte("a"), 64*1024))
+	}))
+	defer upstream.Close()
+
+	body := `{` + manifestFields + `"files":[{"url":"` + upstream.URL + `","filename":"a.txt"}]}`
+	server := zipfly.NewServer("test", zipfly.ServerOptions{Bandwidth: bandwidth})
+
+	startedAt := time.Now()
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, httptest.NewRequest("POST", "/zip", bytes.NewReader([]byte(body))))
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status %v", w.Code)
+	}
+
+	return time.Since(startedAt)
+}
+
+func TestStreamBandwidth(t *testing.T) {
+	if elapsed := throttledDuration(t, zipfly.BandwidthOptions{}, ""); elapsed > 200*time.Millisecond {
+		t.Fatalf("unthrottled stream took %v", elapsed)
+	}
+
+	// about 48 KiB over the first chunk at 128 KiB/s
+	if elapsed := throttledDuration(t, zipfly.BandwidthOptions{StreamBytesPerSecond: 128 * 1024}, ""); elapsed < 300*time.Millisecond {
+		t.Fatalf("stream not throttled: %v", elapsed)
+	}
+
+	if elapsed := throttledDuration(t, zipfly.BandwidthOptions{GlobalBytesPerSecond: 128 * 1024}, ""); elapsed < 300*time.Millisecond {
+		t.Fatalf("stream not throttled by the global rate: %v", elapsed)
+	}
+}
+
+func TestManifestLowersBandwidth(t *testing.T) {
+	if elapsed := throttledDuration(t, zipfly.BandwidthOptions{StreamBytesPerSecond: 16 * 1024 * 1024}, `"max_bytes_per_second":131072,`); elapsed < 300*time.Millisecond {
+		t.Fatalf("manifest rate not applied: %v", elapsed)
+	}
+
+	if elapsed := throttledDuration(t, zipfly.BandwidthOptions{StreamBytesPerSecond: 128 * 1024}, `"max_bytes_per_second":16777216,`); elapsed < 300*time.Millisecond {
+		t.Fatalf("manifest raised the server rate: %v", elapsed)
+	}
+}
@@ -0,0 +1,128 @@
+package testing
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+
+	zipfly "github.com/baptistejub/zipfly/zip_fly"
+)
+
+// Keeps the ended spans
+type spanRecorder struct {
+	mu    sync.Mutex
+	spans []sdktrace.ReadOnlySpan
+}
+
+func (r *spanRecorder) OnStart(ctx context.Context, s sdktrace.ReadWriteSpan) {}
+
+func (r *spanRecorder) OnEnd(s sdktrace.ReadOnlySpan) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.spans = append(r.spans, s)
+}
+
+func (r *spanRecorder) Shutdown(ctx context.Context) error   { return nil }
+func (r *spanRecorder) ForceFlush(ctx context.Context) error { return nil }
+
+func TestTraceparentPropagatedToUpstream(t *testing.T) {
+	if _, err := zipfly.SetupTracing(context.Background(), "none"); err != nil {
+		t.Fatalf("tracing setup failed: %v", err)
+	}
+
+	traceId := "4bf92f3577b34da6a3ce929d0e0e4736"
+	var received string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header.Get("traceparent")
+		w.Write([]byte("Hello, world!"))
+	}))
+	defer upstream.Close()
+
+	body := []byte(`{"files":[{"url":"` + upstream.URL + `","filename":"file.txt"}]}`)
+	req := httptest.NewRequest("POST", "/zip", bytes.NewReader(body))
+	req.Header.Set("traceparent", "00-"+traceId+"-00f067aa0ba902b7-01")
+	w := httptest.NewRecorder()
+
+	zipfly.NewServer("test", zipfly.ServerOptions{}).ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("invalid status: %v", w.Code)
+	}
+
+	if !strings.Contains(received, traceId) {
+		t.Fatalf("trace context not propagated: %q", received)
+	}
+}
+
+func TestSpanNamedAfterRoute(t *testing.T) {
+	recorder := &spanRecorder{}
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	defer otel.SetTracerProvider(previous)
+
+	server := zipfly.NewServer("test", zipfly.ServerOptions{Tenants: map[string]*zipfly.Tenant{"acme": {}}})
+	server.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/t/acme/zip/some-stream/events", nil))
+
+	recorder.mu.Lock()
+	defer recorder.mu.Unlock()
+
+	if len(recorder.spans) != 1 || recorder.spans[0].Name() != "GET /t/{tenant}/zip/{id}/events" {
+		t.Fatalf("server span not named after the route: %v", recorder.spans)
+	}
+
+	for _, attr := range recorder.spans[0].Attributes() {
+		if attr.Key == "url.path" && attr.Value.AsString() != "/t/acme/zip/some-stream/events" {
+			t.Fatalf("concrete path not kept: %s", attr.Value.AsString())
+		}
+	}
+}
+
+func TestSetupTracingUnknownExporter(t *testing.T) {
+	if _, err := zipfly.SetupTracing(context.Background(), "invalid"); err == nil {
+		t.Fatalf("accepted unknown exporter")
+	}
+}
+
+func TestSpansWithoutUrlCredentials(t *testing.T) {
+	recorder := &spanRecorder{}
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	defer otel.SetTracerProvider(previous)
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("Hello, world!"))
+	}))
+	defer upstream.Close()
+
+	body := []byte(`{"files":[{"url":"` + upstream.URL + `/file?X-Amz-Signature=s3cret","filename":"file.txt"}]}`)
+	w := httptest.NewRecorder()
+	zipfly.NewServer("test", zipfly.ServerOptions{}).ServeHTTP(w, httptest.NewRequest("POST", "/zip", bytes.NewReader(body)))
+
+	recorder.mu.Lock()
+	defer recorder.mu.Unlock()
+
+	urls := 0
+	for _, span := range recorder.spans {
+		for _, attr := range span.Attributes() {
+			if strings.Contains(attr.Value.Emit(), "s3cret") {
+				t.Fatalf("%s: %s holds the URL query: %s", span.Name(), attr.Key, attr.Value.Emit())
+			}
+
+			if attr.Value.Emit() == upstream.URL+"/file" {
+				urls++
+			}
+		}
+	}
+
+	// the entry and the upstream call
+	if urls != 2 {
+		t.Fatalf("URLs not recorded: %d", urls)
+	}
+}
@@ -0,0 +1,87 @@
+package testing
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	zipfly "github.com/baptistejub/zipfly/zip_fly"
+)
+
+func TestUpstreamIdleReadTimeout(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("Hello"))
+		w.(http.Flusher).Flush()
+		select {
+		case <-time.After(2 * time.Second):
+		case <-r.Context().Done():
+		}
+	}))
+	defer upstream.Close()
+
+	body := `{"files":[{"url":"` + upstream.URL + `","filename":"a.txt"}]}`
+	server := zipfly.NewServer("test", zipfly.ServerOptions{Upstream: zipfly.UpstreamOptions{IdleReadTimeout: 100 * time.Millisecond}})
+
+	startedAt := time.Now()
+	req := httptest.NewRequest("POST", "/zip", bytes.NewReader([]byte(body)))
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, req)
+
+	if elapsed := time.Since(startedAt); elapsed > time.Second {
+		t.Fatalf("stalled upstream not stopped after %v", elapsed)
+	}
+}
+
+type countingTransport struct {
+	calls int32
+}
+
+func (c *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	atomic.AddInt32(&c.calls, 1)
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestInjectedHTTPClient(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("Hello, world!"))
+	}))
+	defer upstream.Close()
+
+	transport := &countingTransport{}
+	server := zipfly.NewServer("test", zipfly.ServerOptions{HTTPClient: &http.Client{Transport: transport}})
+
+	body := `{"files":[{"url":"` + upstream.URL + `","filename":"a.txt"}]}`
+	req := httptest.NewRequest("POST", "/zip", strings.NewReader(body))
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK || atomic.LoadInt32(&transport.calls) == 0 {
+		t.Fatalf("injected client not used: %v, %d calls", w.Code, transport.calls)
+	}
+}
+
+func TestUpstreamIdleReadTimeoutSlowConsumer(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(bytes.Repeat([]byte("a"), 32*1024))
+	}))
+	defer upstream.Close()
+
+	// each 4 KiB write to the client takes 250ms, longer than the idle read timeout, while the upstream
+	// has already sent everything
+	body := `{"files":[{"url":"` + upstream.URL + `","filename":"a.txt"}]}`
+	server := zipfly.NewServer("test", zipfly.ServerOptions{
+		Upstream:  zipfly.UpstreamOptions{IdleReadTimeout: 100 * time.Millisecond},
+		Bandwidth: zipfly.BandwidthOptions{StreamBytesPerSecond: 16 * 1024},
+	})
+
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, httptest.NewRequest("POST", "/zip", bytes.NewReader([]byte(body))))
+
+	if w.Code != http.StatusOK || w.Body.Len() < 32*1024 {
+		t.Fatalf("healthy upstream stopped while the client was slow: %v, %d bytes", w.Code, w.Body.Len())
+	}
+}
@@ -0,0 +1,166 @@
+package testing
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	zipfly "github.com/baptistejub/zipfly/zip_fly"
+)
+
+func TestCallbackWebhook(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("Hello, world!"))
+	}))
+	defer upstream.Close()
+
+	received := make(chan map[string]interface{}, 1)
+	attempts := 0
+	callback := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if attempts == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		body, _ := io.ReadAll(r.Body)
+		mac := hmac.New(sha256.New, []byte("secret"))
+		mac.Write([]byte(r.Header.Get("X-Zipfly-Expires") + ":" + string(body)))
+		if r.Header.Get("X-Zipfly-Signature") != hex.EncodeToString(mac.Sum(nil)) {
+			t.Errorf("invalid webhook signature")
+		}
+
+		event := make(map[string]interface{})
+		json.Unmarshal(body, &event)
+		received <- event
+	}))
+	defer callback.Close()
+
+	options := zipfly.ServerOptions{
+		SigningSecret: "secret",
+		Webhook:       zipfly.WebhookOptions{MaxAttempts: 2, Timeout: time.Second, InitialBackoff: time.Millisecond, AllowPrivateNetworks: true},
+	}
+	body := []byte(`{"filename":"test.zip","callback_url":"` + callback.URL + `","files":[{"url":"` + upstream.URL + `","filename":"1.txt"}]}`)
+	w := httptest.NewRecorder()
+
+	zipfly.NewServer("test", options).ServeHTTP(w, httptest.NewRequest("POST", "/zip", bytes.NewReader(body)))
+
+	select {
+	case event := <-received:
+		if event["event"] != "archive.completed" || event["filename"] != "test.zip" || event["entries_done"] != float64(1) {
+			t.Fatalf("invalid webhook event: %v", event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("webhook not delivered")
+	}
+}
+
+func TestWebhookPartialOptions(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("Hello, world!"))
+	}))
+	defer upstream.Close()
+
+	var attempts atomic.Int32
+	callback := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts.Add(1)
+	}))
+	defer callback.Close()
+
+	// the timeout and backoff keep their defaults
+	server := zipfly.NewServer("test", zipfly.ServerOptions{Webhook: zipfly.WebhookOptions{MaxAttempts: 3, AllowPrivateNetworks: true}})
+	body := []byte(`{"callback_url":"` + callback.URL + `","files":[{"url":"` + upstream.URL + `","filename":"1.txt"}]}`)
+	server.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/zip", bytes.NewReader(body)))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := server.Drain(ctx); err != nil {
+		t.Fatalf("webhook still pending: %v", err)
+	}
+
+	if attempts.Load() != 1 {
+		t.Fatalf("webhook not delivered with partial options: %d attempts", attempts.Load())
+	}
+}
+
+func TestCallbackUrlInvalid(t *testing.T) {
+	body := []byte(`{"callback_url":"ftp://server.com","files":[{"url":"https://a.com/1","filename":"1.txt"}]}`)
+	w := httptest.NewRecorder()
+
+	zipfly.NewServer("test", zipfly.ServerOptions{}).ServeHTTP(w, httptest.NewRequest("POST", "/zip", bytes.NewReader(body)))
+
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("invalid status: %v", w.Code)
+	}
+}
+
+func TestCallbackPrivateAddress(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("Hello, world!"))
+	}))
+	defer upstream.Close()
+
+	var attempts atomic.Int32
+	callback := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts.Add(1)
+	}))
+	defer callback.Close()
+
+	server := zipfly.NewServer("test", zipfly.ServerOptions{})
+	body := []byte(`{"callback_url":"` + callback.URL + `","files":[{"url":"` + upstream.URL + `","filename":"1.txt"}]}`)
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, httptest.NewRequest("POST", "/zip", bytes.NewReader(body)))
+
+	// not retried, the drain returns once the delivery failed
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := server.Drain(ctx); err != nil {
+		t.Fatalf("webhook still pending: %v", err)
+	}
+
+	if w.Code != http.StatusOK || attempts.Load() != 0 {
+		t.Fatalf("callback on a loopback address called: %v, %d attempts", w.Code, attempts.Load())
+	}
+}
+
+func TestDrainWaitsForWebhooks(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("Hello, world!"))
+	}))
+	defer upstream.Close()
+
+	var attempts atomic.Int32
+	callback := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer callback.Close()
+
+	server := zipfly.NewServer("test", zipfly.ServerOptions{
+		Webhook: zipfly.WebhookOptions{MaxAttempts: 10, Timeout: time.Second, InitialBackoff: time.Hour, AllowPrivateNetworks: true},
+	})
+	body := []byte(`{"callback_url":"` + callback.URL + `","files":[{"url":"` + upstream.URL + `","filename":"1.txt"}]}`)
+	server.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/zip", bytes.NewReader(body)))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	started := time.Now()
+	if err := server.Drain(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("drain didn't wait for the webhook retry: %v", err)
+	}
+
+	// the retry waiting for an hour is aborted
+	if elapsed := time.Since(started); elapsed > 2*time.Second || attempts.Load() != 1 {
+		t.Fatalf("webhook retry not aborted: %v, %d attempts", elapsed, attempts.Load())
+	}
+}
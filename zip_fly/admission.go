@@ -0,0 +1,213 @@
+package zipfly
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	errQueueFull    = errors.New("server busy, the queue is full")
+	errQueueTimeout = errors.New("server busy, timed out in the queue")
+)
+
+type queuedStream struct {
+	client   string
+	admitted bool
+	ready    chan struct{}
+}
+
+// admissionQueue lets at most capacity archives stream at once. The others wait, up to size of them
+// and for maxWait at most, and are admitted in round-robin across the clients.
+type admissionQueue struct {
+	capacity int
+	size     int
+	maxWait  time.Duration
+
+	mu      sync.Mutex
+	running int
+	waiting int
+	// waiting streams of each client, and the clients having some in their admission order
+	queues map[string][]*queuedStream
+	order  []string
+
+	rejected    int64
+	timedOut    int64
+	queued      int64
+	waitSeconds float64
+}
+
+func newAdmissionQueue(capacity, size int, maxWait time.Duration) *admissionQueue {
+	return &admissionQueue{capacity: capacity, size: size, maxWait: maxWait, queues: make(map[string][]*queuedStream)}
+}
+
+// Waits for a stream slot, the returned function releases it
+func (q *admissionQueue) admit(ctx context.Context, client string) (func(), error) {
+	startedAt := time.Now()
+
+	q.mu.Lock()
+	if q.running < q.capacity && q.waiting == 0 {
+		q.running++
+		q.mu.Unlock()
+		return q.releaseFunc(), nil
+	}
+
+	if q.waiting >= q.size {
+		q.rejected++
+		q.mu.Unlock()
+		return nil, errQueueFull
+	}
+
+	stream := &queuedStream{client: client, ready: make(chan struct{})}
+	if len(q.queues[client]) == 0 {
+		q.order = append(q.order, client)
+	}
+	q.queues[client] = append(q.queues[client], stream)
+	q.waiting++
+	q.mu.Unlock()
+
+	timeout := time.NewTimer(q.maxWait)
+	defer timeout.Stop()
+
+	var err error
+	select {
+	case <-stream.ready:
+	case <-timeout.C:
+		err = errQueueTimeout
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.queued++
+	q.waitSeconds += time.Since(startedAt).Seconds()
+
+	// admitted meanwhile
+	if stream.admitted {
+		return q.releaseFunc(), nil
+	}
+
+	q.remove(stream)
+	if err == errQueueTimeout {
+		q.timedOut++
+	}
+
+	return nil, err
+}
+
+func (q *admissionQueue) releaseFunc() func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			q.mu.Lock()
+			defer q.mu.Unlock()
+
+			q.running--
+			q.dispatch()
+		})
+	}
+}
+
+// Admits the next waiting stream of each client in turn while slots are free
+func (q *admissionQueue) dispatch() {
+	for q.running < q.capacity && len(q.order) > 0 {
+		client := q.order[0]
+		q.order = q.order[1:]
+
+		stream := q.queues[client][0]
+		q.queues[client] = q.queues[client][1:]
+		if len(q.queues[client]) > 0 {
+			q.order = append(q.order, client)
+		} else {
+			delete(q.queues, client)
+		}
+
+		q.waiting--
+		q.running++
+		stream.admitted = true
+		close(stream.ready)
+	}
+}
+
+func (q *admissionQueue) remove(stream *queuedStream) {
+	queue := q.queues[stream.client]
+	for i, s := range queue {
+		if s == stream {
+			q.queues[stream.client] = append(queue[:i], queue[i+1:]...)
+			q.waiting--
+			break
+		}
+	}
+
+	if len(q.queues[stream.client]) > 0 {
+		return
+	}
+
+	delete(q.queues, stream.client)
+	for i, client := range q.order {
+		if client == stream.client {
+			q.order = append(q.order[:i], q.order[i+1:]...)
+			break
+		}
+	}
+}
+
+// Writes the queue metrics in the Prometheus text format
+func (q *admissionQueue) writeMetrics(w io.Writer) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	metrics := []struct {
+		name, kind, help string
+		value            interface{}
+	}{
+		{"zipfly_streams_active", "gauge", "Archives being streamed.", q.running},
+		{"zipfly_streams_capacity", "gauge", "Archives that can be streamed at once.", q.capacity},
+		{"zipfly_queue_depth", "gauge", "Archive requests waiting for a stream slot.", q.waiting},
+		{"zipfly_queue_rejected_total", "counter", "Archive requests rejected because the queue was full.", q.rejected},
+		{"zipfly_queue_timeouts_total", "counter", "Archive requests that waited too long in the queue.", q.timedOut},
+	}
+
+	for _, metric := range metrics {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %v\n", metric.name, metric.help, metric.name, metric.kind, metric.name, metric.value)
+	}
+
+	fmt.Fprintf(w, "# HELP zipfly_queue_wait_seconds Time spent waiting in the queue.\n# TYPE zipfly_queue_wait_seconds summary\n")
+	fmt.Fprintf(w, "zipfly_queue_wait_seconds_sum %g\nzipfly_queue_wait_seconds_count %d\n", q.waitSeconds, q.queued)
+}
+
+// Retry-After of the rejected requests
+func (q *admissionQueue) retryAfter() string {
+	return strconv.Itoa(int(math.Max(1, math.Ceil(q.maxWait.Seconds()))))
+}
+
+// Waits for a stream slot once the request is authorized, so that unauthorized requests don't take
+// the place of the others, and before it uses up its limited-use link, so that a rejected request
+// doesn't. The returned function releases the slot.
+func (s *Server) admit(w http.ResponseWriter, req *http.Request) (func(), bool) {
+	if s.queue == nil {
+		return func() {}, true
+	}
+
+	release, err := s.queue.admit(req.Context(), s.rateLimitedClient(req))
+	if err != nil && errors.Is(context.Cause(req.Context()), context.Canceled) {
+		logWithTenant(requestTenant(req), "Client aborted while queued:", req.URL.Path)
+		return nil, false
+	}
+
+	if err != nil {
+		w.Header().Set("Retry-After", s.queue.retryAfter())
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return nil, false
+	}
+
+	return release, true
+}
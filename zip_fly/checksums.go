@@ -0,0 +1,70 @@
+package zipfly
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ChecksumFormat is the file of checksums appended to the archive
+type ChecksumFormat string
+
+const (
+	// SHA256SUMS file, checked with `sha256sum -c SHA256SUMS`
+	ChecksumSha256Sums ChecksumFormat = "sha256sums"
+	// manifest.json file giving the path, size, SHA-256 and source URL of each file
+	ChecksumManifest ChecksumFormat = "manifest"
+)
+
+func (f ChecksumFormat) valid() bool {
+	return f == "" || f == ChecksumSha256Sums || f == ChecksumManifest
+}
+
+// EntryChecksum is computed while the entry is written
+type EntryChecksum struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	Sha256 string `json:"sha256"`
+	Url    string `json:"url"`
+}
+
+// Appends the checksums of the files written, the files skipped on error are left out
+func (z *ZipStreamer) writeChecksums(zipWriter *zip.Writer) error {
+	if z.Checksums == ChecksumManifest {
+		content, err := json.MarshalIndent(map[string][]EntryChecksum{"files": z.EntryChecksums}, "", "  ")
+		if err != nil {
+			return err
+		}
+
+		return z.writeGeneratedEntry(zipWriter, "manifest.json", content)
+	}
+
+	var sums strings.Builder
+	for _, checksum := range z.EntryChecksums {
+		fmt.Fprintf(&sums, "%s  %s\n", checksum.Sha256, checksum.Path)
+	}
+
+	return z.writeGeneratedEntry(zipWriter, "SHA256SUMS", []byte(sums.String()))
+}
+
+// Writes a file generated by the streamer, renamed when a file of the archive has its path
+func (z *ZipStreamer) writeGeneratedEntry(zipWriter *zip.Writer, name string, content []byte) error {
+	paths := newEntryPaths(z.NameEncoding)
+	for _, entry := range z.Entries {
+		paths.add(entry)
+	}
+
+	if paths.get(name) != nil {
+		name = paths.available(name)
+	}
+
+	writer, err := zipWriter.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: time.Now()})
+	if err != nil {
+		return err
+	}
+
+	_, err = writer.Write(content)
+	return err
+}
@@ -0,0 +1,559 @@
+package zipfly
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the configuration of the zipfly binary.
+// Values are read, by increasing priority, from the defaults, the YAML config file, the environment
+// variables and the command-line flags.
+// Each field is bound through its yaml key: "upstream.dial_timeout" is read from the UPSTREAM_DIAL_TIMEOUT
+// env variable and the -upstream-dial-timeout flag, unless an explicit env or flag tag is given.
+// Fields tagged secret are masked when the configuration is printed.
+type Config struct {
+	Port                     string           `yaml:"port" usage:"port to listen on"`
+	PublicUrl                string           `yaml:"public_url" usage:"public URL of the server, used to validate GET signatures (defaults to http://hostname:port)"`
+	Environment              string           `yaml:"environment" usage:"environment name, signatures are always validated in production"`
+	ValidateSignature        bool             `yaml:"validate_signature" env_presence:"true" usage:"whether or not requests signature must be validated, any non-empty env value enables it"`
+	SigningSecret            string           `yaml:"signing_secret" secret:"true" usage:"secret used to sign and validate requests"`
+	SigningKeysFile          string           `yaml:"signing_keys_file" usage:"path to a YAML file of named signing keys, reloaded on SIGHUP"`
+	SigningKeysReload        time.Duration    `yaml:"signing_keys_reload" usage:"interval to check the signing keys file for changes, 0 to only reload on SIGHUP"`
+	RequireManifestSignature bool             `yaml:"require_manifest_signature" usage:"GET source manifests must be signed, unless pinned by the manifest_sha256 param"`
+	TracesExporter           string           `yaml:"traces_exporter" env:"OTEL_TRACES_EXPORTER" usage:"OpenTelemetry trace exporter: none, stdout or otlp"`
+	ReadTimeout              time.Duration    `yaml:"read_timeout" usage:"maximum duration for reading an entire request"`
+	WriteTimeout             time.Duration    `yaml:"write_timeout" usage:"maximum duration before timing out writes of a response, 0 for none"`
+	IdleTimeout              time.Duration    `yaml:"idle_timeout" usage:"maximum duration to wait for the next request on keep-alive connections, 0 for none"`
+	ShutdownGracePeriod      time.Duration    `yaml:"shutdown_grace_period" usage:"time given to the archives being streamed to finish on SIGTERM, before they are aborted"`
+	CorsAllowedOrigins       []string         `yaml:"cors_allowed_origins" usage:"comma separated list of CORS allowed origins"`
+	Upstream                 UpstreamOptions  `yaml:"upstream"`
+	Webhook                  WebhookOptions   `yaml:"webhook"`
+	JWT                      JWTOptions       `yaml:"jwt"`
+	RateLimit                RateLimitOptions `yaml:"rate_limit"`
+	Limits                   LimitsOptions    `yaml:"limits"`
+	Bandwidth                BandwidthOptions `yaml:"bandwidth"`
+	NamePolicy               NamePolicy       `yaml:"name_policy" usage:"entry names sanitization: windows, strict or passthrough"`
+	NonceStore               string           `yaml:"nonce_store" usage:"store of the limited-use links nonces: memory or bolt"`
+	NonceStorePath           string           `yaml:"nonce_store_path" usage:"path of the bolt nonce store database file"`
+	// Only read from the config file
+	Tenants map[string]Tenant `yaml:"tenants"`
+}
+
+const configFileEnv = "ZIPFLY_CONFIG"
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+func DefaultConfig() Config {
+	return Config{
+		Port:                "6969",
+		Environment:         "development",
+		TracesExporter:      "none",
+		NonceStore:          "memory",
+		ReadTimeout:         10 * time.Second,
+		ShutdownGracePeriod: 30 * time.Second,
+		CorsAllowedOrigins:  []string{"*"},
+		Webhook:             defaultWebhookOptions,
+		RateLimit:           RateLimitOptions{By: "ip", QueueMaxWait: defaultQueueMaxWait},
+		Limits:              LimitsOptions{SizeCheck: true},
+		NamePolicy:          NameWindowsSafe,
+		Upstream:            defaultUpstreamOptions,
+	}
+}
+
+// LoadConfig builds the configuration from the config file, the environment and the command-line args.
+// The config file path is given by the -config flag or the ZIPFLY_CONFIG env variable.
+func LoadConfig(name string, args []string) (*Config, error) {
+	config := DefaultConfig()
+	fields := configFields(reflect.ValueOf(&config).Elem(), "")
+
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	configFile := flags.String("config", os.Getenv(configFileEnv), "path to a YAML config file (env "+configFileEnv+")")
+
+	flagValues := make([]*configFlag, len(fields))
+	for i, field := range fields {
+		flagValues[i] = &configFlag{isBool: field.value.Kind() == reflect.Bool}
+		flags.Var(flagValues[i], field.flag, field.usage+" (env "+field.env+")")
+	}
+
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if flags.NArg() > 0 {
+		return nil, fmt.Errorf("unexpected argument: %s", flags.Arg(0))
+	}
+
+	if *configFile != "" {
+		if err := config.loadFile(*configFile); err != nil {
+			return nil, err
+		}
+	}
+
+	for i, field := range fields {
+		if raw, ok := os.LookupEnv(field.env); ok && field.envPresence {
+			if raw != "" {
+				field.value.SetBool(true)
+			}
+		} else if ok {
+			if err := setConfigValue(field.value, raw); err != nil {
+				return nil, fmt.Errorf("env %s: %w", field.env, err)
+			}
+		}
+
+		if flagValues[i].set {
+			if err := setConfigValue(field.value, flagValues[i].raw); err != nil {
+				return nil, fmt.Errorf("flag -%s: %w", field.flag, err)
+			}
+		}
+	}
+
+	if config.PublicUrl == "" {
+		host, err := os.Hostname()
+		if err != nil {
+			return nil, err
+		}
+
+		config.PublicUrl = "http://" + host + ":" + config.Port
+	}
+
+	return &config, nil
+}
+
+func (c *Config) loadFile(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("config file: %w", err)
+	}
+
+	defer file.Close()
+
+	decoder := yaml.NewDecoder(file)
+	decoder.KnownFields(true)
+	if err := decoder.Decode(c); err != nil && err != io.EOF {
+		return fmt.Errorf("config file %s: %w", path, err)
+	}
+
+	return nil
+}
+
+// Validate reports every invalid setting at once
+func (c *Config) Validate() error {
+	var errs []error
+	invalid := func(key, format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf("%s: "+format, append([]interface{}{key}, args...)...))
+	}
+
+	if port, err := strconv.Atoi(c.Port); err != nil || port < 1 || port > 65535 {
+		invalid("port", "must be a number between 1 and 65535, got %q", c.Port)
+	}
+
+	if c.Environment == "" {
+		invalid("environment", "must not be empty")
+	}
+
+	if u, err := url.Parse(c.PublicUrl); err != nil || u.Scheme == "" || u.Host == "" {
+		invalid("public_url", "must be an absolute URL, got %q", c.PublicUrl)
+	}
+
+	if (c.ValidateSignature || c.Environment == "production") && c.SigningSecret == "" && c.SigningKeysFile == "" && !c.JWT.enabled() {
+		invalid("signing_secret", "or signing_keys_file or jwt is required when signatures are validated")
+	}
+
+	if c.JWT.JWKSFile != "" && c.JWT.JWKSUrl != "" {
+		invalid("jwt", "jwks_file and jwks_url can't be both set")
+	} else if c.JWT.JWKSFile != "" {
+		if _, err := NewTokenVerifier(c.JWT); err != nil {
+			invalid("jwt.jwks_file", "%v", err)
+		}
+	}
+
+	if c.SigningKeysFile != "" {
+		if _, err := LoadKeySet(c.SigningKeysFile); err != nil {
+			invalid("signing_keys_file", "%v", err)
+		}
+	}
+
+	for name, tenant := range c.Tenants {
+		key := "tenants." + name
+		if !tenantNameFormat.MatchString(name) {
+			invalid(key, "name must be lowercase letters, digits and dashes")
+		}
+
+		if (c.ValidateSignature || c.Environment == "production") && tenant.SigningSecret == "" && tenant.SigningKeysFile == "" && !c.JWT.enabled() {
+			invalid(key+".signing_secret", "or signing_keys_file is required when signatures are validated")
+		}
+
+		if tenant.SigningKeysFile != "" {
+			if _, err := LoadKeySet(tenant.SigningKeysFile); err != nil {
+				invalid(key+".signing_keys_file", "%v", err)
+			}
+		}
+
+		for _, host := range tenant.AllowedHosts {
+			if host == "" || strings.ContainsAny(host, "/:") {
+				invalid(key+".allowed_hosts", "must be host names, got %q", host)
+			}
+		}
+
+		if tenant.MaxBytes < 0 {
+			invalid(key+".max_bytes", "must not be negative")
+		}
+
+		if tenant.MaxEntries < 0 {
+			invalid(key+".max_entries", "must not be negative")
+		}
+
+		if tenant.MaxBytesPerSecond < 0 {
+			invalid(key+".max_bytes_per_second", "must not be negative")
+		}
+	}
+
+	switch c.TracesExporter {
+	case "", "none", "stdout", "otlp":
+	default:
+		invalid("traces_exporter", "must be one of none, stdout or otlp, got %q", c.TracesExporter)
+	}
+
+	switch c.NonceStore {
+	case "", "memory":
+	case "bolt":
+		if c.NonceStorePath == "" {
+			invalid("nonce_store_path", "is required with the bolt nonce store")
+		}
+	default:
+		invalid("nonce_store", "must be memory or bolt, got %q", c.NonceStore)
+	}
+
+	if len(c.CorsAllowedOrigins) == 0 {
+		invalid("cors_allowed_origins", "must not be empty")
+	}
+
+	switch c.RateLimit.By {
+	case "", "ip", "key", "tenant":
+	default:
+		invalid("rate_limit.by", "must be one of ip, key or tenant, got %q", c.RateLimit.By)
+	}
+
+	if c.RateLimit.RequestsPerSecond < 0 || c.RateLimit.Burst < 0 || c.RateLimit.ConcurrentStreams < 0 || c.RateLimit.GlobalStreams < 0 || c.RateLimit.QueueSize < 0 {
+		invalid("rate_limit", "limits must not be negative")
+	}
+
+	if c.RateLimit.QueueSize > 0 && c.RateLimit.GlobalStreams == 0 {
+		invalid("rate_limit.queue_size", "requires rate_limit.global_streams")
+	}
+
+	if c.Upstream.MaxConnsPerHost < 0 || c.Upstream.MaxIdleConnsPerHost < 0 {
+		invalid("upstream", "connection limits must not be negative")
+	}
+
+	if c.Limits.MaxEntries < 0 || c.Limits.MaxEntryBytes < 0 || c.Limits.MaxBytes < 0 || c.Limits.MaxSpoolBytes < 0 {
+		invalid("limits", "must not be negative")
+	}
+
+	if c.Bandwidth.StreamBytesPerSecond < 0 || c.Bandwidth.GlobalBytesPerSecond < 0 {
+		invalid("bandwidth", "must not be negative")
+	}
+
+	if !c.NamePolicy.valid() {
+		invalid("name_policy", "must be one of windows, strict or passthrough, got %q", c.NamePolicy)
+	}
+
+	if c.Webhook.MaxAttempts < 1 {
+		invalid("webhook.max_attempts", "must be at least 1")
+	}
+
+	if c.Webhook.Timeout <= 0 {
+		invalid("webhook.timeout", "must be positive")
+	}
+
+	for _, field := range configFields(reflect.ValueOf(c).Elem(), "") {
+		if field.value.Type() == durationType && field.value.Int() < 0 {
+			invalid(field.key, "must not be negative")
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func (c *Config) ServerOptions() (ServerOptions, error) {
+	var keys *KeySet
+	if c.SigningKeysFile != "" {
+		var err error
+		if keys, err = LoadKeySet(c.SigningKeysFile); err != nil {
+			return ServerOptions{}, err
+		}
+	}
+
+	var tokenVerifier *TokenVerifier
+	if c.JWT.enabled() {
+		var err error
+		if tokenVerifier, err = NewTokenVerifier(c.JWT); err != nil {
+			return ServerOptions{}, err
+		}
+	}
+
+	var nonceStore NonceStore
+	if c.NonceStore == "bolt" {
+		var err error
+		if nonceStore, err = OpenBoltNonceStore(c.NonceStorePath); err != nil {
+			return ServerOptions{}, fmt.Errorf("nonce store: %w", err)
+		}
+	}
+
+	tenants := make(map[string]*Tenant, len(c.Tenants))
+	for name, tenant := range c.Tenants {
+		if tenant.SigningKeysFile != "" {
+			var err error
+			if tenant.SigningKeys, err = LoadKeySet(tenant.SigningKeysFile); err != nil {
+				return ServerOptions{}, fmt.Errorf("tenant %s: %w", name, err)
+			}
+		}
+
+		tenants[name] = &tenant
+	}
+
+	return ServerOptions{
+		ValidateSignature:        c.ValidateSignature,
+		SigningSecret:            c.SigningSecret,
+		SigningKeys:              keys,
+		RequireManifestSignature: c.RequireManifestSignature,
+		TokenVerifier:            tokenVerifier,
+		NonceStore:               nonceStore,
+		PublicUrl:                c.PublicUrl,
+		CorsAllowedOrigins:       c.CorsAllowedOrigins,
+		Upstream:                 c.Upstream,
+		Webhook:                  c.Webhook,
+		RateLimit:                c.RateLimit,
+		Limits:                   c.Limits,
+		Bandwidth:                c.Bandwidth,
+		NamePolicy:               c.NamePolicy,
+		Tenants:                  tenants,
+	}, nil
+}
+
+// Print writes the configuration as YAML, with secrets masked
+func (c *Config) Print(w io.Writer) error {
+	node, err := configNode(reflect.ValueOf(*c), false)
+	if err != nil {
+		return err
+	}
+
+	encoder := yaml.NewEncoder(w)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(node); err != nil {
+		return err
+	}
+
+	return encoder.Close()
+}
+
+type configField struct {
+	key    string
+	env    string
+	flag   string
+	usage  string
+	secret bool
+	value  reflect.Value
+	// boolean enabled by any non-empty env value, as the env vars of the first versions
+	envPresence bool
+}
+
+// Lists the settings that can be set from the env and the command line: structs are flattened,
+// fields of other kinds (maps, lists of structs) are only read from the config file.
+func configFields(v reflect.Value, prefix string) []configField {
+	fields := make([]configField, 0)
+
+	for i := 0; i < v.NumField(); i++ {
+		structField := v.Type().Field(i)
+		name := strings.Split(structField.Tag.Get("yaml"), ",")[0]
+		if name == "" || name == "-" {
+			continue
+		}
+
+		key := prefix + name
+		value := v.Field(i)
+
+		if value.Kind() == reflect.Struct {
+			fields = append(fields, configFields(value, key+".")...)
+			continue
+		}
+
+		if !isConfigLeaf(value.Type()) {
+			continue
+		}
+
+		field := configField{
+			key:    key,
+			env:    strings.ToUpper(strings.NewReplacer(".", "_").Replace(key)),
+			flag:   strings.NewReplacer(".", "-", "_", "-").Replace(key),
+			usage:  structField.Tag.Get("usage"),
+			secret: structField.Tag.Get("secret") == "true",
+			value:  value,
+
+			envPresence: structField.Tag.Get("env_presence") == "true",
+		}
+
+		if env := structField.Tag.Get("env"); env != "" {
+			field.env = env
+		}
+
+		if flagName := structField.Tag.Get("flag"); flagName != "" {
+			field.flag = flagName
+		}
+
+		fields = append(fields, field)
+	}
+
+	return fields
+}
+
+func isConfigLeaf(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.String, reflect.Bool, reflect.Int, reflect.Int64, reflect.Float64:
+		return true
+	case reflect.Slice:
+		return t.Elem().Kind() == reflect.String
+	}
+
+	return false
+}
+
+func setConfigValue(v reflect.Value, raw string) error {
+	switch {
+	case v.Type() == durationType:
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			return fmt.Errorf("invalid duration %q", raw)
+		}
+		v.SetInt(int64(d))
+	case v.Kind() == reflect.String:
+		v.SetString(raw)
+	case v.Kind() == reflect.Bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return fmt.Errorf("invalid boolean %q", raw)
+		}
+		v.SetBool(b)
+	case v.Kind() == reflect.Int || v.Kind() == reflect.Int64:
+		i, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid integer %q", raw)
+		}
+		v.SetInt(i)
+	case v.Kind() == reflect.Float64:
+		f, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return fmt.Errorf("invalid number %q", raw)
+		}
+		v.SetFloat(f)
+	case v.Kind() == reflect.Slice:
+		items := make([]string, 0)
+		for _, item := range strings.Split(raw, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		v.Set(reflect.ValueOf(items))
+	default:
+		return fmt.Errorf("unsupported setting type %s", v.Type())
+	}
+
+	return nil
+}
+
+// Records the raw flag value so that it can be applied after the config file and the env
+type configFlag struct {
+	raw    string
+	set    bool
+	isBool bool
+}
+
+func (f *configFlag) String() string {
+	return f.raw
+}
+
+func (f *configFlag) Set(raw string) error {
+	f.raw = raw
+	f.set = true
+	return nil
+}
+
+func (f *configFlag) IsBoolFlag() bool {
+	return f.isBool
+}
+
+func configNode(v reflect.Value, secret bool) (*yaml.Node, error) {
+	switch {
+	case v.Type() == durationType:
+		return &yaml.Node{Kind: yaml.ScalarNode, Value: time.Duration(v.Int()).String()}, nil
+	case secret && v.Kind() == reflect.String:
+		if v.String() == "" {
+			return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: ""}, nil
+		}
+		return &yaml.Node{Kind: yaml.ScalarNode, Value: "********"}, nil
+	case v.Kind() == reflect.Struct:
+		node := &yaml.Node{Kind: yaml.MappingNode}
+		for i := 0; i < v.NumField(); i++ {
+			structField := v.Type().Field(i)
+			name := strings.Split(structField.Tag.Get("yaml"), ",")[0]
+			if name == "" || name == "-" {
+				continue
+			}
+
+			child, err := configNode(v.Field(i), structField.Tag.Get("secret") == "true")
+			if err != nil {
+				return nil, err
+			}
+			node.Content = append(node.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: name}, child)
+		}
+		return node, nil
+	case v.Kind() == reflect.Map:
+		node := &yaml.Node{Kind: yaml.MappingNode}
+		keys := v.MapKeys()
+		sort.Slice(keys, func(i, j int) bool { return fmt.Sprint(keys[i]) < fmt.Sprint(keys[j]) })
+		for _, key := range keys {
+			child, err := configNode(v.MapIndex(key), secret)
+			if err != nil {
+				return nil, err
+			}
+			node.Content = append(node.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: fmt.Sprint(key)}, child)
+		}
+		return node, nil
+	case v.Kind() == reflect.Slice:
+		node := &yaml.Node{Kind: yaml.SequenceNode, Style: yaml.FlowStyle}
+		for i := 0; i < v.Len(); i++ {
+			child, err := configNode(v.Index(i), secret)
+			if err != nil {
+				return nil, err
+			}
+			if child.Kind != yaml.ScalarNode {
+				node.Style = 0
+			}
+			node.Content = append(node.Content, child)
+		}
+		return node, nil
+	case v.Kind() == reflect.Ptr:
+		if v.IsNil() {
+			return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!null", Value: "null"}, nil
+		}
+		return configNode(v.Elem(), secret)
+	}
+
+	node := &yaml.Node{}
+	if err := node.Encode(v.Interface()); err != nil {
+		return nil, err
+	}
+
+	return node, nil
+}
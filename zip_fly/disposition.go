@@ -0,0 +1,83 @@
+package zipfly
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+const (
+	defaultArchiveFilename = "archive.zip"
+	archiveExtension       = ".zip"
+)
+
+// ArchiveFilename makes the archive filename safe to save: the directories, control and reserved
+// characters are removed, and the .zip extension added when missing
+func ArchiveFilename(filename string) string {
+	name := norm.NFC.String(filename)
+	if i := strings.LastIndexAny(name, `/\`); i >= 0 {
+		name = name[i+1:]
+	}
+
+	name, _ = sanitizeNameComponent(strings.TrimSpace(name))
+	if strings.Trim(name, "_.") == "" {
+		return defaultArchiveFilename
+	}
+
+	if !strings.EqualFold(path.Ext(name), archiveExtension) {
+		name += archiveExtension
+	}
+
+	if len(name) > maxNameComponentBytes {
+		name = truncateNameComponent(name)
+	}
+
+	return name
+}
+
+// Builds an RFC 6266 attachment header: an ASCII filename for the old clients, and the UTF-8 one
+// encoded as in RFC 5987 when it differs
+func contentDisposition(filename string) string {
+	fallback := asciiFilename(filename)
+	header := fmt.Sprintf("attachment; filename=\"%s\"", fallback)
+	if fallback == filename {
+		return header
+	}
+
+	return header + "; filename*=UTF-8''" + encodeRFC5987(filename)
+}
+
+// Drops the accents and replaces the other non-ASCII characters, quotes and backslashes
+func asciiFilename(filename string) string {
+	var ascii strings.Builder
+	for _, r := range norm.NFD.String(filename) {
+		switch {
+		case unicode.Is(unicode.Mn, r):
+		case r < 0x20 || r >= 0x7f || r == '"' || r == '\\':
+			ascii.WriteRune('_')
+		default:
+			ascii.WriteRune(r)
+		}
+	}
+
+	return ascii.String()
+}
+
+// Percent-encodes the UTF-8 bytes other than the RFC 5987 attr-chars
+func encodeRFC5987(value string) string {
+	const attrChars = "!#$&+-.^_`|~"
+
+	var encoded strings.Builder
+	for _, b := range []byte(value) {
+		if b < 0x80 && (b >= 'a' && b <= 'z' || b >= 'A' && b <= 'Z' || b >= '0' && b <= '9' || strings.IndexByte(attrChars, b) >= 0) {
+			encoded.WriteByte(b)
+		} else {
+			fmt.Fprintf(&encoded, "%%%02X", b)
+		}
+	}
+
+	return encoded.String()
+}
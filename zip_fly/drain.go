@@ -0,0 +1,143 @@
+package zipfly
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Cause of the streams aborted at the end of the drain grace period
+var errServerShutdown = errors.New("server shutting down")
+
+type activeStream struct {
+	req       *http.Request
+	cancel    context.CancelCauseFunc
+	startedAt time.Time
+}
+
+// drainState tracks the /zip requests in progress, so that the server can wait for them on shutdown
+type drainState struct {
+	mu       sync.Mutex
+	draining bool
+	streams  map[*activeStream]struct{}
+	// closed and replaced each time a stream ends
+	changed chan struct{}
+}
+
+func newDrainState() *drainState {
+	return &drainState{streams: make(map[*activeStream]struct{}), changed: make(chan struct{})}
+}
+
+// Registers the request, or returns false once the server is draining
+func (d *drainState) add(req *http.Request) (*activeStream, context.Context, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.draining {
+		return nil, nil, false
+	}
+
+	ctx, cancel := context.WithCancelCause(req.Context())
+	stream := &activeStream{req: req, cancel: cancel, startedAt: time.Now()}
+	d.streams[stream] = struct{}{}
+
+	return stream, ctx, true
+}
+
+func (d *drainState) remove(stream *activeStream) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	stream.cancel(nil)
+	delete(d.streams, stream)
+	close(d.changed)
+	d.changed = make(chan struct{})
+}
+
+func (d *drainState) active() (int, <-chan struct{}) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return len(d.streams), d.changed
+}
+
+// Answers 503 to the new requests once the server is draining, and lets Drain abort the others
+func (s *Server) drainable(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		stream, ctx, ok := s.drain.add(req)
+		if !ok {
+			w.Header().Set("Connection", "close")
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, errServerShutdown.Error(), http.StatusServiceUnavailable)
+			return
+		}
+
+		defer s.drain.remove(stream)
+		next(w, req.WithContext(ctx))
+	}
+}
+
+// Drain stops accepting /zip requests and waits for the archives being streamed, then for the delivery
+// of their callback webhooks. When ctx is done first, the remaining streams and webhooks are aborted
+// and ctx error is returned.
+func (s *Server) Drain(ctx context.Context) error {
+	s.drain.mu.Lock()
+	s.drain.draining = true
+	s.drain.mu.Unlock()
+
+	for {
+		count, changed := s.drain.active()
+		if count == 0 {
+			break
+		}
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			s.abortStreams()
+			s.webhooks.abort()
+			return ctx.Err()
+		}
+	}
+
+	return s.webhooks.wait(ctx)
+}
+
+// Cancels the remaining streams and waits for their handlers to return
+func (s *Server) abortStreams() {
+	s.drain.mu.Lock()
+	for stream := range s.drain.streams {
+		logWithTenant(requestTenant(stream.req), "Aborting stream", stream.req.Method, stream.req.URL.Path, "from", stream.req.RemoteAddr, "started", time.Since(stream.startedAt).Round(time.Second), "ago")
+		stream.cancel(errServerShutdown)
+	}
+	s.drain.mu.Unlock()
+
+	for {
+		count, changed := s.drain.active()
+		if count == 0 {
+			return
+		}
+		<-changed
+	}
+}
+
+// Draining reports whether Drain was called
+func (s *Server) Draining() bool {
+	s.drain.mu.Lock()
+	defer s.drain.mu.Unlock()
+
+	return s.drain.draining
+}
+
+// ReadinessCheck fails once the server is draining, so that it gets no new traffic
+func (s *Server) ReadinessCheck(w http.ResponseWriter, req *http.Request) {
+	if s.Draining() {
+		http.Error(w, "draining", http.StatusServiceUnavailable)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("OK"))
+}
@@ -0,0 +1,82 @@
+package zipfly
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// DuplicatePolicy tells what to do with files having the path of a previous one, compared
+// case-insensitively as macOS and Windows file systems do
+type DuplicatePolicy string
+
+const (
+	// Rejects the manifest
+	DuplicateError DuplicatePolicy = "error"
+	// Appends a counter to the name: "photo (1).jpg"
+	DuplicateRename DuplicatePolicy = "rename"
+	// Keeps the first file
+	DuplicateSkip DuplicatePolicy = "skip"
+	// Keeps the last file
+	DuplicateLastWins DuplicatePolicy = "last_wins"
+)
+
+func (p DuplicatePolicy) valid() bool {
+	switch p {
+	case "", DuplicateError, DuplicateRename, DuplicateSkip, DuplicateLastWins:
+		return true
+	}
+
+	return false
+}
+
+// entryPaths indexes the entries by their case folded path, as written with the name encoding
+type entryPaths struct {
+	entries  map[string]*Entry
+	encoding NameEncoding
+}
+
+func newEntryPaths(encoding NameEncoding) entryPaths {
+	return entryPaths{entries: make(map[string]*Entry), encoding: encoding}
+}
+
+// Paths only differing by characters missing from the code page are the same for some extractors
+func (p entryPaths) key(zipPath string) string {
+	return strings.ToLower(p.encoding.replaceUnencodable(zipPath))
+}
+
+func (p entryPaths) get(zipPath string) *Entry {
+	return p.entries[p.key(zipPath)]
+}
+
+func (p entryPaths) add(entry *Entry) {
+	p.entries[p.key(entry.ZipPath)] = entry
+}
+
+// Returns the first free "name (n).ext" path
+func (p entryPaths) available(zipPath string) string {
+	dir, base := path.Split(zipPath)
+	ext := path.Ext(base)
+	if ext == base {
+		// hidden file without extension, like .env
+		ext = ""
+	}
+	stem := strings.TrimSuffix(base, ext)
+
+	for n := 1; ; n++ {
+		candidate := fmt.Sprintf("%s%s (%d)%s", dir, stem, n, ext)
+		if p.get(candidate) == nil {
+			return candidate
+		}
+	}
+}
+
+func removeEntry(entries []*Entry, removed *Entry) []*Entry {
+	for i, entry := range entries {
+		if entry == removed {
+			return append(entries[:i], entries[i+1:]...)
+		}
+	}
+
+	return entries
+}
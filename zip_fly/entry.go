@@ -2,10 +2,13 @@ package zipfly
 
 import (
 	"archive/zip"
+	"context"
 	"errors"
+	"fmt"
 	"io"
 	"net/http"
 	"net/url"
+	"os"
 	"path"
 	"strings"
 )
@@ -15,6 +18,20 @@ type Entry struct {
 	ZipPath           string
 	CompressionMethod uint16
 	ContentReader     io.ReadCloser
+	// Client used to fetch the content, defaults to a shared upstream client
+	Client *http.Client
+	// Content longer than this fails the entry, 0 for no limit
+	MaxBytes int64
+	// Left out of the archive when it can't be fetched
+	Optional bool
+	// Target of a symbolic link entry, which has no Url
+	Target string
+	// Unix permissions, the zip defaults when 0
+	Mode    os.FileMode
+	Comment string
+	// Owner written in an Info-ZIP Unix extra field when set
+	Uid *int
+	Gid *int
 }
 
 func NewEntry(urlString string, zipPath string, compress bool) (*Entry, error) {
@@ -27,50 +44,108 @@ func NewEntry(urlString string, zipPath string, compress bool) (*Entry, error) {
 		return nil, errors.New("invalid file url")
 	}
 
+	zipPath, err = cleanZipPath(zipPath)
+	if err != nil {
+		return nil, err
+	}
+
+	compressionMethod := zip.Store
+	if compress {
+		compressionMethod = zip.Deflate
+	}
+
+	return &Entry{Url: urlString, ZipPath: zipPath, CompressionMethod: compressionMethod}, nil
+}
+
+func cleanZipPath(zipPath string) (string, error) {
 	zipPath = path.Clean(zipPath)
 	zipPath = strings.TrimPrefix(zipPath, "/")
 
 	if strings.HasPrefix(zipPath, "../") {
-		return nil, errors.New("invalid zip filename: " + zipPath)
+		return "", errors.New("invalid zip filename: " + zipPath)
 	}
 
 	if filename := path.Base(zipPath); len(filename) == 0 || filename == "." {
-		return nil, errors.New("invalid zip filename")
+		return "", errors.New("invalid zip filename")
 	}
 
-	compressionMethod := zip.Store
-	if compress {
-		compressionMethod = zip.Deflate
+	return zipPath, nil
+}
+
+func (e *Entry) Size() uint64 {
+	size := e.SizeContext(context.Background())
+	if size < 0 {
+		return 0
 	}
 
-	return &Entry{Url: urlString, ZipPath: zipPath, CompressionMethod: compressionMethod}, nil
+	return uint64(size)
 }
 
-func (e *Entry) Size() uint64 {
-	res, err := http.Head(e.Url)
+// SizeContext returns the content length reported by a HEAD request, -1 when it's unknown
+func (e *Entry) SizeContext(ctx context.Context) int64 {
+	if e.Target != "" {
+		return int64(len(e.Target))
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, e.Url, nil)
 	if err != nil {
-		return 0
+		return -1
+	}
+
+	res, err := e.client().Do(req)
+	if err != nil {
+		return -1
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return -1
+	}
+
+	return res.ContentLength
+}
+
+func (e *Entry) client() *http.Client {
+	if e.Client != nil {
+		return e.Client
 	}
 
-	return uint64(res.ContentLength)
+	return upstreamClient
 }
 
 func (e *Entry) Content() (io.ReadCloser, error) {
+	return e.ContentContext(context.Background())
+}
+
+// ContentContext is like Content, the upstream request being attached to ctx
+func (e *Entry) ContentContext(ctx context.Context) (io.ReadCloser, error) {
 	if e.ContentReader != nil {
 		return e.ContentReader, nil
 	}
 
-	return e.fetchContent()
+	return e.fetchContent(ctx)
 }
 
-func (e *Entry) fetchContent() (io.ReadCloser, error) {
-	resp, err := http.Get(e.Url)
+func (e *Entry) fetchContent(ctx context.Context) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, e.Url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := e.client().Do(req)
+
+	// without the URL, which may hold credentials and ends up in the progress events
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		return nil, fmt.Errorf("couldn't fetch from URL: %w", urlErr.Err)
+	}
 
 	if err != nil {
 		return nil, err
 	}
 
 	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
 		return nil, errors.New("couldn't fetch from URL")
 	}
 
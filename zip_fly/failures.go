@@ -0,0 +1,175 @@
+package zipfly
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// ErrorPolicy tells what to do when a file can't be fetched
+type ErrorPolicy string
+
+const (
+	// Aborts the archive
+	ErrorAbort ErrorPolicy = "abort"
+	// Leaves the file out and lists it in a report appended to the archive
+	ErrorSkip ErrorPolicy = "skip"
+)
+
+func (p ErrorPolicy) valid() bool {
+	return p == "" || p == ErrorAbort || p == ErrorSkip
+}
+
+// Format of the report of the skipped files: "txt" (default) or "json"
+type ErrorReportFormat string
+
+func (f ErrorReportFormat) valid() bool {
+	return f == "" || f == "txt" || f == "json"
+}
+
+// EntryFailure describes a file that couldn't be added to the archive
+type EntryFailure struct {
+	Path  string `json:"path"`
+	Url   string `json:"url"`
+	Error string `json:"error"`
+}
+
+// The files that may be left out are fetched before their header is written, so that a failure while
+// fetching leaves nothing in the archive. They are kept in memory up to this size, in a temporary file
+// above.
+const maxSpooledMemory = 4 << 20
+
+// Files that may be left out above this size are left out, when no MaxSpoolBytes is set
+const defaultMaxSpoolBytes = 1 << 30
+
+var errSpoolTooLarge = errors.New("file too large to be fetched before being added")
+
+// Wraps the errors of the upstream servers, and the files too large to be spooled, the other ones (writing to the client) always abort
+type upstreamError struct {
+	err error
+}
+
+func (e *upstreamError) Error() string {
+	return e.err.Error()
+}
+
+func (e *upstreamError) Unwrap() error {
+	return e.err
+}
+
+// Records the read error of the content, and stops reading once ctx is done for the contents not
+// fetched with it
+type upstreamReader struct {
+	r   io.Reader
+	ctx context.Context
+	err error
+}
+
+func (u *upstreamReader) Read(p []byte) (int, error) {
+	if err := u.ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	n, err := u.r.Read(p)
+	if err != nil && err != io.EOF {
+		u.err = err
+	}
+	return n, err
+}
+
+func (z *ZipStreamer) maxSpoolBytes() int64 {
+	if z.MaxSpoolBytes > 0 {
+		return z.MaxSpoolBytes
+	}
+
+	return defaultMaxSpoolBytes
+}
+
+// Whether the entry is left out when it can't be fetched
+func (z *ZipStreamer) mayLeaveOut(entry *Entry) bool {
+	return entry.Optional || z.OnError == ErrorSkip
+}
+
+// spooledContent is the whole content of an entry, read before the entry is written
+type spooledContent struct {
+	io.Reader
+	// nil when the content is in memory
+	file *os.File
+}
+
+func (s *spooledContent) Close() error {
+	if s.file == nil {
+		return nil
+	}
+
+	s.file.Close()
+	return os.Remove(s.file.Name())
+}
+
+// Reads the whole content, failing with errSpoolTooLarge above maxBytes
+func spool(r io.Reader, maxBytes int64) (*spooledContent, error) {
+	tooLarge := fmt.Errorf("%w: the limit is %d bytes", errSpoolTooLarge, maxBytes)
+	r = io.LimitReader(r, maxBytes+1)
+
+	var buffer bytes.Buffer
+	if _, err := io.CopyN(&buffer, r, maxSpooledMemory+1); err == io.EOF {
+		if int64(buffer.Len()) > maxBytes {
+			return nil, tooLarge
+		}
+		return &spooledContent{Reader: &buffer}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	file, err := os.CreateTemp("", "zipfly-spool-*")
+	if err != nil {
+		return nil, err
+	}
+	spooled := &spooledContent{Reader: file, file: file}
+
+	if n, err := io.Copy(file, io.MultiReader(&buffer, r)); err != nil {
+		spooled.Close()
+		return nil, err
+	} else if n > maxBytes {
+		spooled.Close()
+		return nil, tooLarge
+	}
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		spooled.Close()
+		return nil, err
+	}
+
+	return spooled, nil
+}
+
+// Appends the report of the skipped files
+func (z *ZipStreamer) writeErrorReport(zipWriter *zip.Writer) error {
+	var content []byte
+	if z.ErrorReport == "json" {
+		var err error
+		if content, err = json.MarshalIndent(map[string][]EntryFailure{"failed": z.Failed}, "", "  "); err != nil {
+			return err
+		}
+	} else {
+		var report strings.Builder
+		fmt.Fprintf(&report, "%d file(s) couldn't be added to this archive:\n", len(z.Failed))
+		for _, failure := range z.Failed {
+			fmt.Fprintf(&report, "\n%s\n  URL: %s\n  Error: %s\n", failure.Path, failure.Url, failure.Error)
+		}
+		content = []byte(report.String())
+	}
+
+	name := "_errors.txt"
+	if z.ErrorReport == "json" {
+		name = "_errors.json"
+	}
+
+	return z.writeGeneratedEntry(zipWriter, name, content)
+}
@@ -0,0 +1,311 @@
+package zipfly
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+	"golang.org/x/sync/singleflight"
+)
+
+var tokenAlgorithms = []jose.SignatureAlgorithm{
+	jose.RS256, jose.RS384, jose.RS512, jose.PS256, jose.PS384, jose.PS512, jose.ES256, jose.ES384, jose.ES512, jose.EdDSA,
+}
+
+const (
+	// Tolerated clock skew when validating the token dates
+	tokenLeeway = 30 * time.Second
+	// Minimum delay between two JWKS URL refreshes triggered by an unknown key ID
+	jwksMinRefreshInterval = time.Minute
+)
+
+// Returned when a token doesn't allow the requested archive
+var errTokenNotAllowed = errors.New("token doesn't allow this archive")
+
+// JWTOptions configures the JWT bearer tokens accepted instead of the request signature
+type JWTOptions struct {
+	JWKSFile string        `yaml:"jwks_file" usage:"path to the JWKS used to verify JWT bearer tokens"`
+	JWKSUrl  string        `yaml:"jwks_url" usage:"URL of the JWKS used to verify JWT bearer tokens"`
+	Refresh  time.Duration `yaml:"jwks_refresh" usage:"interval to reload the JWKS, 0 to only reload on SIGHUP"`
+	Issuer   string        `yaml:"issuer" usage:"expected iss claim of the JWT bearer tokens, if any"`
+	Audience string        `yaml:"audience" usage:"expected aud claim of the JWT bearer tokens, if any"`
+}
+
+func (o JWTOptions) enabled() bool {
+	return o.JWKSFile != "" || o.JWKSUrl != ""
+}
+
+// zipClaims are the claims of a JWT bearer token: the token must be limited to a source URL (GET) or
+// a manifest (GET and POST)
+type zipClaims struct {
+	jwt.Claims
+	Source         string `json:"source,omitempty"`
+	ManifestSha256 string `json:"manifest_sha256,omitempty"`
+	Filename       string `json:"filename,omitempty"`
+	MaxBytes       int64  `json:"max_bytes,omitempty"`
+	MaxEntries     int    `json:"max_entries,omitempty"`
+	// Download speed of the archive in bytes per second
+	MaxBytesPerSecond int64 `json:"max_bytes_per_second,omitempty"`
+	// Uses allowed for the token jti, defaults to 1
+	MaxUses int `json:"max_uses,omitempty"`
+	// Tenant of the request, when it's not given by its path or host
+	Tenant string `json:"tenant,omitempty"`
+}
+
+// TokenVerifier verifies JWT bearer tokens against a JWKS loaded from a file or a URL
+type TokenVerifier struct {
+	options JWTOptions
+	client  *http.Client
+
+	mu   sync.RWMutex
+	keys jose.JSONWebKeySet
+	// last reload, successful or not, so that a failing JWKS URL isn't fetched for each token
+	reloadedAt time.Time
+	// collapses the concurrent reloads into one
+	reloads singleflight.Group
+}
+
+func NewTokenVerifier(options JWTOptions) (*TokenVerifier, error) {
+	if (options.JWKSFile == "") == (options.JWKSUrl == "") {
+		return nil, errors.New("either the JWKS file or the JWKS URL must be set")
+	}
+
+	v := &TokenVerifier{options: options, client: &http.Client{Timeout: 10 * time.Second}}
+	if err := v.Reload(); err != nil {
+		return nil, err
+	}
+
+	return v, nil
+}
+
+// Reload reads the JWKS again, the current keys are kept when it's invalid
+func (v *TokenVerifier) Reload() error {
+	_, err, _ := v.reloads.Do("", func() (interface{}, error) {
+		return nil, v.reload()
+	})
+
+	return err
+}
+
+// Reloads the JWKS, unless it was already less than interval ago. The concurrent calls wait for the
+// reload in progress instead.
+func (v *TokenVerifier) reloadAfter(interval time.Duration) error {
+	_, err, _ := v.reloads.Do("", func() (interface{}, error) {
+		v.mu.RLock()
+		due := time.Since(v.reloadedAt) > interval
+		v.mu.RUnlock()
+
+		if !due {
+			return nil, nil
+		}
+
+		return nil, v.reload()
+	})
+
+	return err
+}
+
+func (v *TokenVerifier) reload() error {
+	v.mu.Lock()
+	v.reloadedAt = time.Now()
+	v.mu.Unlock()
+
+	content, err := v.readJWKS()
+	if err != nil {
+		return fmt.Errorf("JWKS: %w", err)
+	}
+
+	var keys jose.JSONWebKeySet
+	if err := json.Unmarshal(content, &keys); err != nil {
+		return fmt.Errorf("JWKS: %w", err)
+	}
+
+	if len(keys.Keys) == 0 {
+		return errors.New("JWKS: no key defined")
+	}
+
+	v.mu.Lock()
+	v.keys = keys
+	v.mu.Unlock()
+
+	return nil
+}
+
+// Refresh reloads the JWKS periodically, until ctx is done
+func (v *TokenVerifier) Refresh(ctx context.Context) {
+	if v.options.Refresh <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(v.options.Refresh)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := v.Reload(); err != nil {
+				fmt.Println("Couldn't refresh the JWKS, keeping the current keys:", err.Error())
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (v *TokenVerifier) readJWKS() ([]byte, error) {
+	if v.options.JWKSFile != "" {
+		return os.ReadFile(v.options.JWKSFile)
+	}
+
+	resp, err := v.client.Get(v.options.JWKSUrl)
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	return io.ReadAll(resp.Body)
+}
+
+// Finds the verification key, refreshing a JWKS URL when the key ID is unknown (new key after a rotation)
+func (v *TokenVerifier) key(kid string) (*jose.JSONWebKey, error) {
+	v.mu.RLock()
+	key := findJWK(v.keys, kid)
+	v.mu.RUnlock()
+
+	if key == nil && v.options.JWKSUrl != "" {
+		if err := v.reloadAfter(jwksMinRefreshInterval); err != nil {
+			return nil, err
+		}
+
+		v.mu.RLock()
+		key = findJWK(v.keys, kid)
+		v.mu.RUnlock()
+	}
+
+	if key == nil {
+		return nil, errors.New("unknown token key")
+	}
+
+	return key, nil
+}
+
+// Without key ID, the JWKS must have a single key
+func findJWK(keys jose.JSONWebKeySet, kid string) *jose.JSONWebKey {
+	if kid == "" {
+		if len(keys.Keys) == 1 {
+			return &keys.Keys[0]
+		}
+		return nil
+	}
+
+	if matching := keys.Key(kid); len(matching) > 0 {
+		return &matching[0]
+	}
+
+	return nil
+}
+
+func (v *TokenVerifier) verify(token string) (*zipClaims, error) {
+	parsed, err := jwt.ParseSigned(token, tokenAlgorithms)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := v.key(parsed.Headers[0].KeyID)
+	if err != nil {
+		return nil, err
+	}
+
+	var claims zipClaims
+	if err := parsed.Claims(key, &claims); err != nil {
+		return nil, err
+	}
+
+	if claims.Expiry == nil {
+		return nil, errors.New("token has no expiry")
+	}
+
+	expected := jwt.Expected{Issuer: v.options.Issuer, Time: time.Now()}
+	if v.options.Audience != "" {
+		expected.AnyAudience = jwt.Audience{v.options.Audience}
+	}
+
+	if err := claims.ValidateWithLeeway(expected, tokenLeeway); err != nil {
+		return nil, err
+	}
+
+	if claims.Source == "" && claims.ManifestSha256 == "" {
+		return nil, errors.New("token must be limited to a source or a manifest")
+	}
+
+	return &claims, nil
+}
+
+// Token from the Authorization header or the token query string param
+func bearerToken(req *http.Request) string {
+	if token, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer "); ok {
+		return strings.TrimSpace(token)
+	}
+
+	return req.URL.Query().Get("token")
+}
+
+func (c *zipClaims) authorizeSource(sourceUrl string) error {
+	if c.Source != "" && c.Source != sourceUrl {
+		return fmt.Errorf("%w: source mismatch", errTokenNotAllowed)
+	}
+
+	return nil
+}
+
+// A POST request token must be limited to its manifest, a GET request token can be limited to its source only
+func (c *zipClaims) authorizeManifest(manifest []byte, required bool) error {
+	if c.ManifestSha256 == "" {
+		if required {
+			return fmt.Errorf("%w: token must be limited to a manifest", errTokenNotAllowed)
+		}
+		return nil
+	}
+
+	digest := sha256.Sum256(manifest)
+	if !strings.EqualFold(c.ManifestSha256, hex.EncodeToString(digest[:])) {
+		return fmt.Errorf("%w: manifest mismatch", errTokenNotAllowed)
+	}
+
+	return nil
+}
+
+// Applies the filename and the limits of the token to the payload
+func (c *zipClaims) apply(payload *zipPayload, requestedFilename string) error {
+	if c.Filename != "" {
+		if requestedFilename != "" && requestedFilename != c.Filename {
+			return fmt.Errorf("%w: filename mismatch", errTokenNotAllowed)
+		}
+
+		payload.Filename = c.Filename
+	} else if requestedFilename != "" {
+		payload.Filename = requestedFilename
+	}
+
+	payload.maxBytes = c.MaxBytes
+	payload.maxEntries = c.MaxEntries
+	payload.maxBytesPerSecond = c.MaxBytesPerSecond
+
+	return nil
+}
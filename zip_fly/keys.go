@@ -0,0 +1,253 @@
+package zipfly
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// SigningKey is a named key, valid between NotBefore and NotAfter when they are set.
+// It's either an HMAC secret, or the PEM encoded public key of an Ed25519 or ECDSA P-256 key pair.
+type SigningKey struct {
+	Secret    string    `yaml:"secret"`
+	PublicKey string    `yaml:"public_key"`
+	NotBefore time.Time `yaml:"not_before"`
+	NotAfter  time.Time `yaml:"not_after"`
+
+	publicKey crypto.PublicKey
+}
+
+func (k *SigningKey) parse() error {
+	if (k.Secret == "") == (k.PublicKey == "") {
+		return errors.New("either secret or public_key must be set")
+	}
+
+	if !k.NotBefore.IsZero() && !k.NotAfter.IsZero() && !k.NotAfter.After(k.NotBefore) {
+		return errors.New("not_after must be after not_before")
+	}
+
+	if k.PublicKey == "" {
+		return nil
+	}
+
+	block, _ := pem.Decode([]byte(k.PublicKey))
+	if block == nil {
+		return errors.New("public_key is not PEM encoded")
+	}
+
+	publicKey, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return fmt.Errorf("invalid public_key: %w", err)
+	}
+
+	switch publicKey := publicKey.(type) {
+	case ed25519.PublicKey:
+	case *ecdsa.PublicKey:
+		if publicKey.Curve != elliptic.P256() {
+			return errors.New("public_key: only the P-256 curve is supported")
+		}
+	default:
+		return errors.New("public_key: only Ed25519 and ECDSA P-256 keys are supported")
+	}
+
+	k.publicKey = publicKey
+
+	return nil
+}
+
+// Public key signatures are base64 URL encoded, ASN.1 DER for ECDSA (SHA-256 digest of the message).
+// HMAC signatures are hex encoded.
+func (k SigningKey) verify(message, signature []byte) bool {
+	switch publicKey := k.publicKey.(type) {
+	case ed25519.PublicKey:
+		decoded, err := decodeSignature(signature)
+		return err == nil && ed25519.Verify(publicKey, message, decoded)
+	case *ecdsa.PublicKey:
+		decoded, err := decodeSignature(signature)
+		digest := sha256.Sum256(message)
+		return err == nil && ecdsa.VerifyASN1(publicKey, digest[:], decoded)
+	}
+
+	return validateHMAC(message, signature, []byte(k.Secret))
+}
+
+func decodeSignature(signature []byte) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(string(signature), "="))
+}
+
+func (k SigningKey) validAt(t time.Time) bool {
+	return (k.NotBefore.IsZero() || !t.Before(k.NotBefore)) && (k.NotAfter.IsZero() || t.Before(k.NotAfter))
+}
+
+// KeySet holds the signing keys by key ID (kid), loaded from a YAML file:
+//
+//	keys:
+//	  2024-01:
+//	    secret: my-old-secret
+//	    not_after: 2024-02-15T00:00:00Z
+//	  2024-02:
+//	    secret: my-new-secret
+//	    not_before: 2024-02-01T00:00:00Z
+//	  links-service:
+//	    public_key: |
+//	      -----BEGIN PUBLIC KEY-----
+//	      MCowBQYDK2VwAyEA...
+//	      -----END PUBLIC KEY-----
+//
+// The file can be reloaded while serving, to rotate keys with overlap.
+type KeySet struct {
+	path    string
+	mu      sync.RWMutex
+	keys    map[string]SigningKey
+	modTime time.Time
+}
+
+type keySetFile struct {
+	Keys map[string]SigningKey `yaml:"keys"`
+}
+
+func LoadKeySet(path string) (*KeySet, error) {
+	k := &KeySet{path: path}
+	if err := k.Reload(); err != nil {
+		return nil, err
+	}
+
+	return k, nil
+}
+
+// NewKeySet builds a key set from memory, it can't be reloaded. The keys are copied, the given map
+// is left untouched.
+func NewKeySet(keys map[string]SigningKey) (*KeySet, error) {
+	keys = maps.Clone(keys)
+	if err := parseKeys(keys); err != nil {
+		return nil, err
+	}
+
+	return &KeySet{keys: keys}, nil
+}
+
+func parseKeys(keys map[string]SigningKey) error {
+	if len(keys) == 0 {
+		return errors.New("no key defined")
+	}
+
+	for kid, key := range keys {
+		if err := key.parse(); err != nil {
+			return fmt.Errorf("key %q: %w", kid, err)
+		}
+
+		keys[kid] = key
+	}
+
+	return nil
+}
+
+// Reload reads the keys file again, the current keys are kept when it's invalid
+func (k *KeySet) Reload() error {
+	if k.path == "" {
+		return nil
+	}
+
+	info, err := os.Stat(k.path)
+	if err != nil {
+		return fmt.Errorf("signing keys: %w", err)
+	}
+
+	content, err := os.ReadFile(k.path)
+	if err != nil {
+		return fmt.Errorf("signing keys: %w", err)
+	}
+
+	var parsed keySetFile
+	if err := yaml.Unmarshal(content, &parsed); err != nil {
+		return fmt.Errorf("signing keys %s: %w", k.path, err)
+	}
+
+	if err := parseKeys(parsed.Keys); err != nil {
+		return fmt.Errorf("signing keys %s: %w", k.path, err)
+	}
+
+	k.mu.Lock()
+	k.keys = parsed.Keys
+	k.modTime = info.ModTime()
+	k.mu.Unlock()
+
+	return nil
+}
+
+// ReloadIfModified reloads the keys file when its modification time changed
+func (k *KeySet) ReloadIfModified() error {
+	if k.path == "" {
+		return nil
+	}
+
+	info, err := os.Stat(k.path)
+	if err != nil {
+		return fmt.Errorf("signing keys: %w", err)
+	}
+
+	k.mu.RLock()
+	modified := !info.ModTime().Equal(k.modTime)
+	k.mu.RUnlock()
+
+	if !modified {
+		return nil
+	}
+
+	return k.Reload()
+}
+
+// Returns the key, if it exists and is currently valid
+func (k *KeySet) key(kid string) (SigningKey, bool) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	key, ok := k.keys[kid]
+	if !ok || !key.validAt(time.Now()) {
+		return SigningKey{}, false
+	}
+
+	return key, true
+}
+
+// Returns the currently valid secret that became valid last, used to sign outgoing requests
+func (k *KeySet) current() (string, string, bool) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	kids := make([]string, 0, len(k.keys))
+	for kid, key := range k.keys {
+		if key.Secret != "" && key.validAt(time.Now()) {
+			kids = append(kids, kid)
+		}
+	}
+
+	if len(kids) == 0 {
+		return "", "", false
+	}
+
+	sort.Slice(kids, func(i, j int) bool {
+		a, b := k.keys[kids[i]].NotBefore, k.keys[kids[j]].NotBefore
+		if a.Equal(b) {
+			return kids[i] > kids[j]
+		}
+		return a.After(b)
+	})
+
+	return kids[0], k.keys[kids[0]].Secret, true
+}
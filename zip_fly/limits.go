@@ -0,0 +1,123 @@
+package zipfly
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Concurrent HEAD requests of the size check
+const sizeCheckConcurrency = 8
+
+var (
+	errArchiveTooLarge = errors.New("archive size limit exceeded")
+	errEntryTooLarge   = errors.New("file size limit exceeded")
+)
+
+// LimitsOptions bounds the archives, 0 for no limit. The limits of a request are the lowest of these,
+// its tenant, its token and its manifest.
+type LimitsOptions struct {
+	MaxEntries    int   `yaml:"max_entries" usage:"maximum number of files in an archive, 0 for none"`
+	MaxEntryBytes int64 `yaml:"max_entry_bytes" usage:"maximum size of a file, 0 for none"`
+	MaxBytes      int64 `yaml:"max_bytes" usage:"maximum size of an archive, 0 for none"`
+	// Files that may be left out are fetched in full, to a temporary file, before being added
+	MaxSpoolBytes int64 `yaml:"max_spool_bytes" usage:"files that may be left out above this size are left out, defaults to 1 GiB"`
+	// Rejects the archives before streaming when the upstream servers report sizes over the limits
+	SizeCheck bool `yaml:"size_check" usage:"check the file sizes with HEAD requests before streaming"`
+}
+
+// Returns the lowest limit, 0 being no limit
+func lowerLimit(current, limit int64) int64 {
+	if limit > 0 && (current == 0 || limit < current) {
+		return limit
+	}
+
+	return current
+}
+
+// Applies the server limits and the ones of the manifest, which can only lower them
+func (p *zipPayload) lowerLimits(limits LimitsOptions) {
+	p.maxBytes = lowerLimit(lowerLimit(p.maxBytes, limits.MaxBytes), p.MaxBytes)
+	p.maxEntryBytes = lowerLimit(lowerLimit(p.maxEntryBytes, limits.MaxEntryBytes), p.MaxEntryBytes)
+	p.maxEntries = int(lowerLimit(lowerLimit(int64(p.maxEntries), int64(limits.MaxEntries)), int64(p.MaxEntries)))
+}
+
+// Fetches the file sizes with HEAD requests. Files of unknown size are left to the hard stop while
+// streaming, compressed ones only count against the file limit.
+func (s *Server) checkSizes(ctx context.Context, entries []*Entry, maxBytes, maxEntryBytes int64) error {
+	sizes := make([]int64, len(entries))
+	slots := make(chan struct{}, sizeCheckConcurrency)
+	var wg sync.WaitGroup
+
+	for i, entry := range entries {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func() {
+			defer wg.Done()
+			sizes[i] = entry.SizeContext(ctx)
+			<-slots
+		}()
+	}
+	wg.Wait()
+
+	var total int64
+	for i, entry := range entries {
+		if maxEntryBytes > 0 && sizes[i] > maxEntryBytes {
+			return &EntryError{Entry: entry, Err: fmt.Errorf("%w: %d bytes, the limit is %d", errEntryTooLarge, sizes[i], maxEntryBytes)}
+		}
+
+		if sizes[i] > 0 && entry.CompressionMethod == 0 {
+			total += sizes[i]
+		}
+	}
+
+	if maxBytes > 0 && total > maxBytes {
+		return fmt.Errorf("%w: %d bytes, the limit is %d", errArchiveTooLarge, total, maxBytes)
+	}
+
+	return nil
+}
+
+// Fails the write that would exceed the limit
+type limitedWriter struct {
+	w         io.Writer
+	remaining int64
+}
+
+func (l *limitedWriter) Write(p []byte) (int, error) {
+	if int64(len(p)) > l.remaining {
+		return 0, errArchiveTooLarge
+	}
+
+	n, err := l.w.Write(p)
+	l.remaining -= int64(n)
+	return n, err
+}
+
+// Fails the read going over the limit
+type limitedReader struct {
+	r         io.Reader
+	remaining int64
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.remaining <= 0 {
+		// the content may end right at the limit
+		var probe [1]byte
+		n, err := l.r.Read(probe[:])
+		if n > 0 {
+			return 0, errEntryTooLarge
+		}
+		return 0, err
+	}
+
+	if int64(len(p)) > l.remaining {
+		p = p[:l.remaining]
+	}
+
+	n, err := l.r.Read(p)
+	l.remaining -= int64(n)
+	return n, err
+}
@@ -0,0 +1,78 @@
+package zipfly
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// Returned when a fetched manifest isn't signed or pinned as required, or doesn't match its signature or pin
+var errManifestNotAllowed = errors.New("manifest not allowed")
+
+// Checks the manifest fetched from a GET source against the manifest_sha256 param pinned in the signed URL,
+// or else its embedded signature when RequireManifestSignature is set
+func (s *Server) verifyManifest(query url.Values, manifest []byte, payload *zipPayload, claims *zipClaims, tenant *Tenant) error {
+	if pinned := query.Get("manifest_sha256"); pinned != "" {
+		digest := sha256.Sum256(manifest)
+		if !strings.EqualFold(pinned, hex.EncodeToString(digest[:])) {
+			return fmt.Errorf("%w: manifest_sha256 mismatch", errManifestNotAllowed)
+		}
+		return nil
+	}
+
+	// already checked against the token
+	if claims != nil && claims.ManifestSha256 != "" {
+		return nil
+	}
+
+	if !s.options.RequireManifestSignature {
+		return nil
+	}
+
+	if payload.Signature == "" {
+		return fmt.Errorf("%w: manifest isn't signed", errManifestNotAllowed)
+	}
+
+	key, ok := s.signingKey(tenant, payload.KeyId)
+	if !ok {
+		return fmt.Errorf("%w: unknown manifest key", errManifestNotAllowed)
+	}
+
+	canonical, err := canonicalManifest(manifest)
+	if err != nil {
+		return err
+	}
+
+	if !key.verify(canonical, []byte(payload.Signature)) {
+		return fmt.Errorf("%w: invalid manifest signature", errManifestNotAllowed)
+	}
+
+	return nil
+}
+
+// The canonical content of a manifest is its JSON without the signature field, objects keys sorted,
+// without whitespace nor HTML escaping. Numbers are kept as written.
+func canonicalManifest(manifest []byte) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(manifest))
+	decoder.UseNumber()
+
+	var fields map[string]interface{}
+	if err := decoder.Decode(&fields); err != nil {
+		return nil, err
+	}
+	delete(fields, "signature")
+
+	var canonical bytes.Buffer
+	encoder := json.NewEncoder(&canonical)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(fields); err != nil {
+		return nil, err
+	}
+
+	return bytes.TrimSuffix(canonical.Bytes(), []byte("\n")), nil
+}
@@ -0,0 +1,210 @@
+package zipfly
+
+import (
+	"archive/zip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// File type of the symbolic link entries
+const FileTypeSymlink = "symlink"
+
+// Info-ZIP New Unix extra field ID, holding the uid and gid
+const unixOwnerExtraId = 0x7875
+
+var errCommentTooLong = errors.New("archive comment too long")
+
+// NewSymlinkEntry creates an entry linking to target, which must stay inside the archive
+func NewSymlinkEntry(zipPath string, target string) (*Entry, error) {
+	zipPath, err := cleanZipPath(zipPath)
+	if err != nil {
+		return nil, err
+	}
+
+	if target == "" || strings.HasPrefix(target, "/") || strings.Contains(target, `\`) || strings.Contains(target, ":") {
+		return nil, fmt.Errorf("invalid symlink target %q for %s", target, zipPath)
+	}
+
+	if resolved := path.Join(path.Dir(zipPath), target); resolved == ".." || strings.HasPrefix(resolved, "../") {
+		return nil, fmt.Errorf("symlink target %q of %s is outside the archive", target, zipPath)
+	}
+
+	return &Entry{ZipPath: zipPath, CompressionMethod: zip.Store, Target: target}, nil
+}
+
+// Maximum symlinks followed to resolve a path
+const maxSymlinkHops = 40
+
+// Rejects the entries written through a symlink entry, and the symlinks resolving outside the archive
+// once the other symlinks are followed. Paths are compared case-insensitively, like the duplicates.
+func checkSymlinks(entries []*Entry) error {
+	links := make(map[string]string)
+	for _, entry := range entries {
+		if entry.Target != "" {
+			links[strings.ToLower(entry.ZipPath)] = entry.Target
+		}
+	}
+
+	if len(links) == 0 {
+		return nil
+	}
+
+	for _, entry := range entries {
+		for dir := path.Dir(entry.ZipPath); dir != "."; dir = path.Dir(dir) {
+			if _, ok := links[strings.ToLower(dir)]; ok {
+				return fmt.Errorf("invalid zip filename %s: inside the symlink %s", entry.ZipPath, dir)
+			}
+		}
+
+		if entry.Target == "" {
+			continue
+		}
+
+		if err := resolveInArchive(links, path.Dir(entry.ZipPath)+"/"+entry.Target); err != nil {
+			return fmt.Errorf("symlink target %q of %s: %w", entry.Target, entry.ZipPath, err)
+		}
+	}
+
+	return nil
+}
+
+// Walks the path from the archive root like a file system would, following the symlinks before
+// applying the next ".." components
+func resolveInArchive(links map[string]string, target string) error {
+	var resolved []string
+	pending := strings.Split(target, "/")
+	hops := 0
+
+	for len(pending) > 0 {
+		component := pending[0]
+		pending = pending[1:]
+
+		switch component {
+		case "", ".":
+			continue
+		case "..":
+			if len(resolved) == 0 {
+				return errors.New("outside the archive")
+			}
+			resolved = resolved[:len(resolved)-1]
+			continue
+		}
+
+		resolved = append(resolved, component)
+		if link, ok := links[strings.ToLower(strings.Join(resolved, "/"))]; ok {
+			if hops++; hops > maxSymlinkHops {
+				return errors.New("too many levels of symlinks")
+			}
+
+			resolved = resolved[:len(resolved)-1]
+			pending = append(strings.Split(link, "/"), pending...)
+		}
+	}
+
+	return nil
+}
+
+// Builds the entry of a manifest file, with its type and metadata
+func newFileEntry(file File, zipPath string) (*Entry, error) {
+	var entry *Entry
+	var err error
+	switch file.Type {
+	case "", "file":
+		entry, err = NewEntry(file.Url, zipPath, file.Compress)
+	case FileTypeSymlink:
+		if file.Url != "" {
+			return nil, fmt.Errorf("symlink %s can't have an url", zipPath)
+		}
+		entry, err = NewSymlinkEntry(zipPath, file.Target)
+	default:
+		return nil, fmt.Errorf("unknown file type %q", file.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if file.Mode != "" {
+		mode, err := strconv.ParseUint(file.Mode, 8, 32)
+		if err != nil || mode > 0o777 {
+			return nil, fmt.Errorf("invalid mode %q for %s, expected octal permissions such as 0755", file.Mode, zipPath)
+		}
+		entry.Mode = os.FileMode(mode)
+	}
+
+	if len(file.Comment) > math.MaxUint16 {
+		return nil, fmt.Errorf("comment of %s too long", zipPath)
+	}
+
+	for _, id := range []*int{file.Uid, file.Gid} {
+		if id != nil && (*id < 0 || int64(*id) > math.MaxUint32) {
+			return nil, fmt.Errorf("invalid uid or gid for %s", zipPath)
+		}
+	}
+
+	entry.Optional = file.Optional
+	entry.Comment = file.Comment
+	entry.Uid = file.Uid
+	entry.Gid = file.Gid
+
+	return entry, nil
+}
+
+// Sets the Unix mode, comment and owner of the header
+func (e *Entry) applyMetadata(header *zip.FileHeader) {
+	switch {
+	case e.Target != "":
+		header.SetMode(os.ModeSymlink | 0o777)
+	case e.Mode != 0:
+		header.SetMode(e.Mode)
+	}
+
+	header.Comment = e.Comment
+
+	if e.Uid != nil || e.Gid != nil {
+		header.Extra = append(header.Extra, unixOwnerExtra(e.Uid, e.Gid)...)
+	}
+}
+
+// Version 1, then the uid and gid on 4 bytes each, 0 when not given
+func unixOwnerExtra(uid, gid *int) []byte {
+	field := make([]byte, 15)
+	binary.LittleEndian.PutUint16(field, unixOwnerExtraId)
+	binary.LittleEndian.PutUint16(field[2:], 11)
+	field[4] = 1
+
+	field[5] = 4
+	if uid != nil {
+		binary.LittleEndian.PutUint32(field[6:], uint32(*uid))
+	}
+
+	field[10] = 4
+	if gid != nil {
+		binary.LittleEndian.PutUint32(field[11:], uint32(*gid))
+	}
+
+	return field
+}
+
+// The content of a symlink entry is its target
+func (z *ZipStreamer) writeSymlink(zipWriter *zip.Writer, entry *Entry) (int64, error) {
+	header := &zip.FileHeader{Name: entry.ZipPath, Method: zip.Store, Modified: time.Now()}
+	if err := z.NameEncoding.encodeHeader(header); err != nil {
+		return 0, err
+	}
+	entry.applyMetadata(header)
+
+	writer, err := zipWriter.CreateHeader(header)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := writer.Write([]byte(entry.Target))
+	return int64(n), err
+}
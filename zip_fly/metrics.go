@@ -0,0 +1,99 @@
+package zipfly
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"sync"
+)
+
+// archiveMetrics counts the archives of each tenant, the ones without tenant under the "" label
+type archiveMetrics struct {
+	mu      sync.Mutex
+	tenants map[string]*tenantArchives
+}
+
+type tenantArchives struct {
+	active int
+	// finished archives by result: done, failed or aborted
+	finished map[string]int64
+	bytes    int64
+}
+
+func newArchiveMetrics() *archiveMetrics {
+	return &archiveMetrics{tenants: make(map[string]*tenantArchives)}
+}
+
+func (m *archiveMetrics) tenant(name string) *tenantArchives {
+	t := m.tenants[name]
+	if t == nil {
+		t = &tenantArchives{finished: make(map[string]int64)}
+		m.tenants[name] = t
+	}
+
+	return t
+}
+
+func (m *archiveMetrics) start(tenant *Tenant) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.tenant(tenant.Name()).active++
+}
+
+func (m *archiveMetrics) finish(tenant *Tenant, result resultEventData) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	status := "done"
+	if result.Aborted {
+		status = "aborted"
+	} else if result.Error != "" {
+		status = "failed"
+	}
+
+	t := m.tenant(tenant.Name())
+	t.active--
+	t.finished[status]++
+	t.bytes += result.BytesWritten
+}
+
+// Writes the archive metrics in the Prometheus text format, with a tenant label
+func (m *archiveMetrics) writeMetrics(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	names := make([]string, 0, len(m.tenants))
+	for name := range m.tenants {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	fmt.Fprintf(w, "# HELP zipfly_archives_active Archives being streamed, by tenant.\n# TYPE zipfly_archives_active gauge\n")
+	for _, name := range names {
+		fmt.Fprintf(w, "zipfly_archives_active{tenant=%q} %d\n", name, m.tenants[name].active)
+	}
+
+	fmt.Fprintf(w, "# HELP zipfly_archives_total Archives streamed, by tenant and result (done, failed or aborted).\n# TYPE zipfly_archives_total counter\n")
+	for _, name := range names {
+		for _, status := range []string{"done", "failed", "aborted"} {
+			fmt.Fprintf(w, "zipfly_archives_total{tenant=%q,result=%q} %d\n", name, status, m.tenants[name].finished[status])
+		}
+	}
+
+	fmt.Fprintf(w, "# HELP zipfly_archive_bytes_total Bytes sent to the clients, by tenant.\n# TYPE zipfly_archive_bytes_total counter\n")
+	for _, name := range names {
+		fmt.Fprintf(w, "zipfly_archive_bytes_total{tenant=%q} %d\n", name, m.tenants[name].bytes)
+	}
+}
+
+// HandleMetrics exposes the archives of each tenant, and the stream slots and queue metrics for
+// autoscaling when the queue is enabled
+func (s *Server) HandleMetrics(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	if s.queue != nil {
+		s.queue.writeMetrics(w)
+	}
+	s.metrics.writeMetrics(w)
+}
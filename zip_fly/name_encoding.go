@@ -0,0 +1,130 @@
+package zipfly
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"strings"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/japanese"
+	"golang.org/x/text/encoding/simplifiedchinese"
+)
+
+// NameEncoding tells how the entry names are written in the ZIP headers
+type NameEncoding string
+
+const (
+	// UTF-8 names with the language encoding flag, the Go default
+	NameUtf8 NameEncoding = "utf8"
+	// CP437 names, with the UTF-8 ones in an Info-ZIP Unicode Path extra field for the extractors reading it
+	NameUtf8UnicodePathExtra NameEncoding = "utf8+unicode-path-extra"
+	// Legacy code pages, for the extractors using the system locale
+	NameCP437    NameEncoding = "cp437"
+	NameShiftJIS NameEncoding = "shift-jis"
+	NameGBK      NameEncoding = "gbk"
+)
+
+// Info-ZIP Unicode Path extra field ID
+const unicodePathExtraId = 0x7075
+
+func (e NameEncoding) valid() bool {
+	return e == "" || e == NameUtf8 || e.codePage() != nil
+}
+
+func (e NameEncoding) codePage() encoding.Encoding {
+	switch e {
+	case NameUtf8UnicodePathExtra, NameCP437:
+		return charmap.CodePage437
+	case NameShiftJIS:
+		return japanese.ShiftJIS
+	case NameGBK:
+		return simplifiedchinese.GBK
+	}
+
+	return nil
+}
+
+// Sets the name of the header in the encoding, leaving it UTF-8 by default
+func (e NameEncoding) encodeHeader(header *zip.FileHeader) error {
+	codePage := e.codePage()
+	if codePage == nil {
+		return nil
+	}
+
+	if err := e.checkName(header.Name); err != nil {
+		return err
+	}
+
+	utf8Name := header.Name
+	encoded, err := codePage.NewEncoder().String(e.replaceUnencodable(utf8Name))
+	if err != nil {
+		return err
+	}
+	header.Name = encoded
+	header.NonUTF8 = true
+
+	if e == NameUtf8UnicodePathExtra && header.Name != utf8Name {
+		header.Extra = append(header.Extra, unicodePathExtra(header.Name, utf8Name)...)
+	}
+
+	return nil
+}
+
+// Rejects the names that a legacy code page can't hold as is: with characters missing from it, or
+// whose bytes hold 0x5C, read as a path separator by the extractors (e.g. ソ is 0x83 0x5C in Shift-JIS).
+// The Unicode Path extra field keeps the UTF-8 names, the code page one is only a fallback.
+func (e NameEncoding) checkName(name string) error {
+	codePage := e.codePage()
+	if codePage == nil || e == NameUtf8UnicodePathExtra {
+		return nil
+	}
+
+	encoder := codePage.NewEncoder()
+	for _, r := range name {
+		b, err := encoder.Bytes([]byte(string(r)))
+		if err != nil {
+			return fmt.Errorf("%q can't be written in %s: %q is missing from the code page", name, e, r)
+		}
+
+		if r != '\\' && bytes.IndexByte(b, '\\') >= 0 {
+			return fmt.Errorf("%q can't be written in %s: %q would be read as a backslash", name, e, r)
+		}
+	}
+
+	return nil
+}
+
+// Replaces with _ the characters missing from the code page, giving the name read by the extractors
+// ignoring the Unicode Path extra field
+func (e NameEncoding) replaceUnencodable(name string) string {
+	codePage := e.codePage()
+	if codePage == nil {
+		return name
+	}
+
+	encoder := codePage.NewEncoder()
+	return strings.Map(func(r rune) rune {
+		if _, err := encoder.Bytes([]byte(string(r))); err != nil {
+			return '_'
+		}
+		return r
+	}, name)
+}
+
+// Version 1, the CRC-32 of the header name it stands for, then the UTF-8 name
+func unicodePathExtra(headerName, utf8Name string) []byte {
+	data := make([]byte, 5, 5+len(utf8Name))
+	data[0] = 1
+	binary.LittleEndian.PutUint32(data[1:], crc32.ChecksumIEEE([]byte(headerName)))
+	data = append(data, utf8Name...)
+
+	field := make([]byte, 4, 4+len(data))
+	binary.LittleEndian.PutUint16(field, unicodePathExtraId)
+	binary.LittleEndian.PutUint16(field[2:], uint16(len(data)))
+
+	return append(field, data...)
+}
@@ -0,0 +1,141 @@
+package zipfly
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// NamePolicy tells how the entry paths are made safe to extract on every platform
+type NamePolicy string
+
+const (
+	// Paths are only cleaned, as given
+	NamePassthrough NamePolicy = "passthrough"
+	// Reserved names and characters are replaced, long names truncated. The default.
+	NameWindowsSafe NamePolicy = "windows"
+	// Paths that would need a replacement are rejected
+	NameStrict NamePolicy = "strict"
+)
+
+// Maximum length of a path component in bytes, the limit of most file systems
+const maxNameComponentBytes = 255
+
+// Characters not allowed in Windows file names, besides the control characters
+const reservedNameChars = `<>:"|?*`
+
+// Windows device names, reserved whatever the extension
+var reservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true, "CONIN$": true, "CONOUT$": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true, "COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true, "LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// NameChange reports an entry path changed by the name policy
+type NameChange struct {
+	Original  string `json:"original"`
+	Sanitized string `json:"sanitized"`
+}
+
+func (p NamePolicy) valid() bool {
+	switch p {
+	case "", NamePassthrough, NameWindowsSafe, NameStrict:
+		return true
+	}
+
+	return false
+}
+
+// Normalizes the path to NFC and makes each component safe, the path is then cleaned by NewEntry
+func (p NamePolicy) sanitize(zipPath string) (string, error) {
+	if !p.valid() {
+		return "", fmt.Errorf("unknown name policy %q", p)
+	}
+
+	if p == NamePassthrough {
+		return zipPath, nil
+	}
+
+	name := norm.NFC.String(zipPath)
+
+	if strings.Contains(name, `\`) {
+		if p == NameStrict {
+			return "", fmt.Errorf("invalid zip filename %q: backslash", zipPath)
+		}
+		name = strings.ReplaceAll(name, `\`, "/")
+	}
+
+	name = strings.TrimPrefix(path.Clean(name), "/")
+	// rejected by NewEntry
+	if name == "." || name == ".." || strings.HasPrefix(name, "../") {
+		return name, nil
+	}
+
+	components := strings.Split(name, "/")
+	for i, component := range components {
+		sanitized, problem := sanitizeNameComponent(component)
+		if problem != "" && p == NameStrict {
+			return "", fmt.Errorf("invalid zip filename %q: %s", zipPath, problem)
+		}
+		components[i] = sanitized
+	}
+
+	return strings.Join(components, "/"), nil
+}
+
+// Returns the safe component, and what was wrong with it
+func sanitizeNameComponent(component string) (string, string) {
+	problem := ""
+
+	sanitized := strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f {
+			problem = "control character"
+			return '_'
+		}
+		if strings.ContainsRune(reservedNameChars, r) {
+			problem = fmt.Sprintf("reserved character %q", r)
+			return '_'
+		}
+		return r
+	}, component)
+
+	if trimmed := strings.TrimRight(sanitized, ". "); trimmed != sanitized {
+		problem = "trailing dot or space"
+		sanitized = trimmed
+		if sanitized == "" {
+			sanitized = "_"
+		}
+	}
+
+	base, _, _ := strings.Cut(sanitized, ".")
+	if reservedNames[strings.ToUpper(strings.TrimRight(base, " "))] {
+		problem = "reserved name " + base
+		sanitized = "_" + sanitized
+	}
+
+	if len(sanitized) > maxNameComponentBytes {
+		problem = fmt.Sprintf("longer than %d bytes", maxNameComponentBytes)
+		sanitized = truncateNameComponent(sanitized)
+	}
+
+	return sanitized, problem
+}
+
+// Truncates the component to the length limit on a character boundary, keeping its extension
+func truncateNameComponent(component string) string {
+	ext := path.Ext(component)
+	if len(ext) > maxNameComponentBytes/2 {
+		ext = ""
+	}
+
+	stem := component[:len(component)-len(ext)]
+	limit := maxNameComponentBytes - len(ext)
+	for limit > 0 && !utf8.RuneStart(stem[limit]) {
+		limit--
+	}
+
+	return stem[:limit] + ext
+}
@@ -0,0 +1,239 @@
+package zipfly
+
+import (
+	"encoding/binary"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Interval between two prunings of the expired nonces
+const noncePruneInterval = time.Minute
+
+// Returned when a limited-use link was already used its maximum number of times
+var errLinkUsed = errors.New("link already used")
+
+// NonceStore records the uses of the limited-use links.
+// Use records one use of the nonce and returns false when it was already used maxUses times.
+// A nonce can be forgotten once expiresAt is passed, as the link is then rejected anyway.
+type NonceStore interface {
+	Use(nonce string, maxUses int, expiresAt time.Time) (bool, error)
+}
+
+type nonceUses struct {
+	count     int
+	expiresAt time.Time
+}
+
+// MemoryNonceStore keeps the nonces in memory, they are lost on restart
+type MemoryNonceStore struct {
+	mu       sync.Mutex
+	nonces   map[string]nonceUses
+	prunedAt time.Time
+}
+
+func NewMemoryNonceStore() *MemoryNonceStore {
+	return &MemoryNonceStore{nonces: make(map[string]nonceUses), prunedAt: time.Now()}
+}
+
+func (m *MemoryNonceStore) Use(nonce string, maxUses int, expiresAt time.Time) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(m.prunedAt) > noncePruneInterval {
+		for n, uses := range m.nonces {
+			if now.After(uses.expiresAt) {
+				delete(m.nonces, n)
+			}
+		}
+		m.prunedAt = now
+	}
+
+	uses := m.nonces[nonce]
+	if uses.count >= maxUses {
+		return false, nil
+	}
+
+	m.nonces[nonce] = nonceUses{count: uses.count + 1, expiresAt: expiresAt}
+
+	return true, nil
+}
+
+var nonceBucket = []byte("nonces")
+
+// BoltNonceStore keeps the nonces in an embedded database file, they persist across restarts
+type BoltNonceStore struct {
+	db       *bolt.DB
+	mu       sync.Mutex
+	prunedAt time.Time
+}
+
+func OpenBoltNonceStore(path string) (*BoltNonceStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(nonceBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &BoltNonceStore{db: db}, nil
+}
+
+func (b *BoltNonceStore) Close() error {
+	return b.db.Close()
+}
+
+// Values are the expiration timestamp followed by the uses count
+func (b *BoltNonceStore) Use(nonce string, maxUses int, expiresAt time.Time) (bool, error) {
+	b.pruneIfNeeded()
+
+	allowed := false
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(nonceBucket)
+
+		count := uint64(0)
+		if value := bucket.Get([]byte(nonce)); len(value) == 16 {
+			count = binary.BigEndian.Uint64(value[8:])
+		}
+
+		if count >= uint64(maxUses) {
+			return nil
+		}
+
+		allowed = true
+		value := make([]byte, 16)
+		binary.BigEndian.PutUint64(value, uint64(expiresAt.Unix()))
+		binary.BigEndian.PutUint64(value[8:], count+1)
+		return bucket.Put([]byte(nonce), value)
+	})
+
+	return allowed, err
+}
+
+func (b *BoltNonceStore) pruneIfNeeded() {
+	b.mu.Lock()
+	if time.Since(b.prunedAt) < noncePruneInterval {
+		b.mu.Unlock()
+		return
+	}
+	b.prunedAt = time.Now()
+	b.mu.Unlock()
+
+	now := uint64(time.Now().Unix())
+	b.db.Update(func(tx *bolt.Tx) error {
+		cursor := tx.Bucket(nonceBucket).Cursor()
+		for key, value := cursor.First(); key != nil; key, value = cursor.Next() {
+			if len(value) != 16 || binary.BigEndian.Uint64(value) < now {
+				if err := cursor.Delete(); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// linkUse describes the nonce of a limited-use link, covered by its signature or token
+type linkUse struct {
+	nonce     string
+	maxUses   int
+	expiresAt time.Time
+}
+
+// Nonce, max_uses and expires query string params of a signed GET request
+func linkUseFromQueryString(req *http.Request, claims *zipClaims) (*linkUse, error) {
+	if claims != nil {
+		return claims.linkUse(), nil
+	}
+
+	query := req.URL.Query()
+	return newLinkUse(query.Get("nonce"), query.Get("max_uses"), query.Get("expires"))
+}
+
+// Nonce and max_uses manifest fields, X-Zipfly-Expires header of a signed POST request
+func linkUseFromBody(req *http.Request, payload *zipPayload, claims *zipClaims) (*linkUse, error) {
+	if claims != nil {
+		return claims.linkUse(), nil
+	}
+
+	maxUses := ""
+	if payload.MaxUses > 0 {
+		maxUses = strconv.Itoa(payload.MaxUses)
+	}
+
+	return newLinkUse(payload.Nonce, maxUses, req.Header.Get("X-Zipfly-Expires"))
+}
+
+func newLinkUse(nonce, maxUses, expires string) (*linkUse, error) {
+	if nonce == "" {
+		return nil, nil
+	}
+
+	use := &linkUse{nonce: nonce, maxUses: 1}
+	if maxUses != "" {
+		var err error
+		if use.maxUses, err = strconv.Atoi(maxUses); err != nil || use.maxUses < 1 {
+			return nil, errors.New("invalid max_uses")
+		}
+	}
+
+	expiresTimestamp, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil {
+		return nil, errors.New("a link with a nonce must expire")
+	}
+	use.expiresAt = time.Unix(expiresTimestamp, 0)
+
+	return use, nil
+}
+
+// The jti claim is the nonce of a token
+func (c *zipClaims) linkUse() *linkUse {
+	if c.ID == "" {
+		return nil
+	}
+
+	maxUses := c.MaxUses
+	if maxUses < 1 {
+		maxUses = 1
+	}
+
+	return &linkUse{nonce: "jwt:" + c.ID, maxUses: maxUses, expiresAt: c.Expiry.Time()}
+}
+
+// Records the use of a limited-use link, answering 410 when it was already used.
+// The nonces of each tenant are distinct.
+func (s *Server) useLink(w http.ResponseWriter, use *linkUse, tenant *Tenant) bool {
+	if use == nil {
+		return true
+	}
+
+	nonce := use.nonce
+	if tenant != nil {
+		nonce = "tenant:" + tenant.name + ":" + nonce
+	}
+
+	allowed, err := s.options.NonceStore.Use(nonce, use.maxUses, use.expiresAt)
+	if err != nil {
+		http.Error(w, "couldn't check the link nonce", http.StatusInternalServerError)
+		return false
+	}
+
+	if !allowed {
+		http.Error(w, errLinkUsed.Error(), http.StatusGone)
+		return false
+	}
+
+	return true
+}
@@ -0,0 +1,396 @@
+package zipfly
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const streamIdHeader = "X-Zipfly-Stream-Id"
+
+const (
+	// How long the events of a finished stream stay available
+	streamRetention = 5 * time.Minute
+	// How long an events request waits for a stream that is not started yet
+	streamStartWait = 30 * time.Second
+	// Interval between two byte counter updates
+	progressInterval = time.Second
+	// Events kept for each stream, the oldest ones are dropped above
+	maxStreamEvents = 1000
+	// Events requests waiting at once for a stream that is not started yet
+	maxWaitingSubscribers = 1000
+)
+
+var errTooManySubscribers = errors.New("too many requests waiting for a stream")
+
+// Client provided stream IDs must be hard to guess, like a UUID
+var streamIdFormat = regexp.MustCompile(`^[A-Za-z0-9_-]{16,64}$`)
+
+type streamEvent struct {
+	Type string
+	Data interface{}
+}
+
+type entryEventData struct {
+	Index        int    `json:"index"`
+	Path         string `json:"path"`
+	Bytes        int64  `json:"bytes,omitempty"`
+	ArchiveBytes int64  `json:"archive_bytes"`
+	EntriesDone  int    `json:"entries_done"`
+	Error        string `json:"error,omitempty"`
+}
+
+type progressEventData struct {
+	BytesWritten int64 `json:"bytes_written"`
+	EntriesDone  int   `json:"entries_done"`
+	EntriesTotal int   `json:"entries_total"`
+}
+
+type resultEventData struct {
+	Filename      string `json:"filename"`
+	BytesWritten  int64  `json:"bytes_written"`
+	EntriesDone   int    `json:"entries_done"`
+	EntriesTotal  int    `json:"entries_total"`
+	EntriesFailed int    `json:"entries_failed,omitempty"`
+	DurationMs    int64  `json:"duration_ms"`
+	Error         string `json:"error,omitempty"`
+	FailedEntry   string `json:"failed_entry,omitempty"`
+	// The client disconnected before the end of the archive
+	Aborted bool `json:"aborted,omitempty"`
+}
+
+// streamProgress records the events of one archive stream for its subscribers
+type streamProgress struct {
+	id           string
+	startedAt    time.Time
+	bytesWritten int64
+
+	mu           sync.Mutex
+	filename     string
+	entriesTotal int
+	entriesDone  int
+	// entries skipped because they couldn't be fetched
+	entriesFailed int
+	events        []streamEvent
+	// events dropped from the start, the ID of events[0]
+	dropped  int
+	finished bool
+	// closed and replaced each time an event is added
+	changed chan struct{}
+}
+
+type streamRegistry struct {
+	mu      sync.Mutex
+	streams map[string]*streamProgress
+	waiting int
+	// closed and replaced each time a stream is registered
+	added chan struct{}
+}
+
+func newStreamRegistry() *streamRegistry {
+	return &streamRegistry{streams: make(map[string]*streamProgress), added: make(chan struct{})}
+}
+
+// Registers a new stream, using the client provided ID when it's valid and not in use
+func (r *streamRegistry) start(requestedId string) *streamProgress {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	id := requestedId
+	if _, used := r.streams[id]; used || !streamIdFormat.MatchString(id) {
+		id = newStreamId()
+	}
+
+	progress := &streamProgress{id: id, startedAt: time.Now(), changed: make(chan struct{})}
+	r.streams[id] = progress
+
+	close(r.added)
+	r.added = make(chan struct{})
+
+	return progress
+}
+
+func (r *streamRegistry) get(id string) (*streamProgress, <-chan struct{}) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.streams[id], r.added
+}
+
+func (r *streamRegistry) remove(id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.streams, id)
+}
+
+// Waits for the stream to be registered, the client may subscribe before starting the download
+func (r *streamRegistry) wait(req *http.Request, id string) (*streamProgress, error) {
+	progress, _ := r.get(id)
+	if progress != nil || !streamIdFormat.MatchString(id) {
+		return progress, nil
+	}
+
+	r.mu.Lock()
+	if r.waiting >= maxWaitingSubscribers {
+		r.mu.Unlock()
+		return nil, errTooManySubscribers
+	}
+	r.waiting++
+	r.mu.Unlock()
+
+	defer func() {
+		r.mu.Lock()
+		r.waiting--
+		r.mu.Unlock()
+	}()
+
+	timeout := time.NewTimer(streamStartWait)
+	defer timeout.Stop()
+
+	for {
+		progress, added := r.get(id)
+		if progress != nil {
+			return progress, nil
+		}
+
+		select {
+		case <-added:
+		case <-timeout.C:
+			return nil, nil
+		case <-req.Context().Done():
+			return nil, nil
+		}
+	}
+}
+
+func newStreamId() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+
+	return hex.EncodeToString(b)
+}
+
+func (p *streamProgress) publish(eventType string, data interface{}) {
+	p.appendEvent(streamEvent{Type: eventType, Data: data}, false)
+}
+
+func (p *streamProgress) appendEvent(event streamEvent, final bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	// the oldest half is dropped at once, the final event is always kept
+	if len(p.events) >= maxStreamEvents {
+		drop := len(p.events) / 2
+		p.events = append(p.events[:0:0], p.events[drop:]...)
+		p.dropped += drop
+	}
+
+	p.events = append(p.events, event)
+	p.finished = final
+	close(p.changed)
+	p.changed = make(chan struct{})
+}
+
+func (p *streamProgress) begin(filename string, entriesTotal int) {
+	p.mu.Lock()
+	p.filename = filename
+	p.entriesTotal = entriesTotal
+	p.mu.Unlock()
+
+	p.publish("start", map[string]interface{}{"id": p.id, "filename": filename, "entries_total": entriesTotal})
+}
+
+func (p *streamProgress) onProgress(event ProgressEvent) {
+	data := entryEventData{Index: event.Index, Path: event.Entry.ZipPath, ArchiveBytes: event.ArchiveBytes}
+
+	if !event.Done {
+		data.EntriesDone = p.snapshot().EntriesDone
+		p.publish("entry_start", data)
+		return
+	}
+
+	p.mu.Lock()
+	if event.Err != nil {
+		p.entriesFailed++
+	} else {
+		p.entriesDone++
+	}
+	data.EntriesDone = p.entriesDone
+	p.mu.Unlock()
+
+	if event.Err != nil {
+		data.Error = event.Err.Error()
+		p.publish("entry_failed", data)
+		return
+	}
+
+	data.Bytes = event.EntryBytes
+	p.publish("entry_done", data)
+}
+
+// Publishes the final event, the stream is then forgotten after the retention delay
+func (p *streamProgress) finish(registry *streamRegistry, err error) resultEventData {
+	snapshot := p.snapshot()
+	p.mu.Lock()
+	entriesFailed := p.entriesFailed
+	p.mu.Unlock()
+
+	result := resultEventData{
+		EntriesFailed: entriesFailed,
+		Filename:      p.filename,
+		BytesWritten:  snapshot.BytesWritten,
+		EntriesDone:   snapshot.EntriesDone,
+		EntriesTotal:  snapshot.EntriesTotal,
+		DurationMs:    time.Since(p.startedAt).Milliseconds(),
+	}
+
+	eventType := "done"
+	if err != nil {
+		eventType = "error"
+		result.Error = err.Error()
+		if errors.Is(err, ErrClientAborted) {
+			eventType = "aborted"
+			result.Aborted = true
+		}
+
+		var entryErr *EntryError
+		if errors.As(err, &entryErr) {
+			result.FailedEntry = entryErr.Entry.ZipPath
+		}
+	}
+
+	p.appendEvent(streamEvent{Type: eventType, Data: result}, true)
+
+	time.AfterFunc(streamRetention, func() { registry.remove(p.id) })
+
+	return result
+}
+
+func (p *streamProgress) snapshot() progressEventData {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return progressEventData{
+		BytesWritten: atomic.LoadInt64(&p.bytesWritten),
+		EntriesDone:  p.entriesDone,
+		EntriesTotal: p.entriesTotal,
+	}
+}
+
+// Returns the events from the cursor, or from the oldest one kept, with the ID of the first one
+func (p *streamProgress) eventsSince(cursor int) ([]streamEvent, int, bool, <-chan struct{}) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	cursor = min(max(cursor, p.dropped), p.dropped+len(p.events))
+
+	return p.events[cursor-p.dropped:], cursor, p.finished, p.changed
+}
+
+// Wraps the client writer to count the bytes sent
+func (p *streamProgress) writer(w io.Writer) io.Writer {
+	return &progressWriter{w: w, progress: p}
+}
+
+type progressWriter struct {
+	w        io.Writer
+	progress *streamProgress
+}
+
+func (pw *progressWriter) Write(b []byte) (int, error) {
+	n, err := pw.w.Write(b)
+	atomic.AddInt64(&pw.progress.bytesWritten, int64(n))
+	return n, err
+}
+
+// HandleStreamEvents sends the progress of an archive stream as Server-Sent Events
+func (s *Server) HandleStreamEvents(w http.ResponseWriter, req *http.Request) {
+	progress, err := s.streams.wait(req, mux.Vars(req)["id"])
+	if err != nil {
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	if progress == nil {
+		http.Error(w, "unknown stream", http.StatusNotFound)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	// resume after the last received event on reconnection
+	cursor := 0
+	if lastId, err := strconv.Atoi(req.Header.Get("Last-Event-ID")); err == nil {
+		cursor = lastId + 1
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	ticker := time.NewTicker(progressInterval)
+	defer ticker.Stop()
+
+	for {
+		events, first, finished, changed := progress.eventsSince(cursor)
+		cursor = first
+		for _, event := range events {
+			if err := writeServerSentEvent(w, strconv.Itoa(cursor), event.Type, event.Data); err != nil {
+				return
+			}
+			cursor++
+		}
+		flusher.Flush()
+
+		if finished {
+			return
+		}
+
+		select {
+		case <-changed:
+		case <-ticker.C:
+			if err := writeServerSentEvent(w, "", "progress", progress.snapshot()); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-req.Context().Done():
+			return
+		}
+	}
+}
+
+func writeServerSentEvent(w io.Writer, id, eventType string, data interface{}) error {
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	if id != "" {
+		if _, err := fmt.Fprintf(w, "id: %s\n", id); err != nil {
+			return err
+		}
+	}
+
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", eventType, encoded)
+	return err
+}
@@ -0,0 +1,286 @@
+package zipfly
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Interval between two prunings of the idle clients
+const rateLimitPruneInterval = time.Minute
+
+// RateLimitOptions limits the /zip requests of each client, identified by its IP, its signing key ID or
+// its tenant. 0 disables a limit.
+type RateLimitOptions struct {
+	RequestsPerSecond float64 `yaml:"requests_per_second" usage:"sustained /zip requests per second allowed to each client, 0 for no limit"`
+	Burst             int     `yaml:"burst" usage:"requests a client can make at once above its rate, defaults to the rate rounded up"`
+	ConcurrentStreams int     `yaml:"concurrent_streams" usage:"archives streamed at once to each client, 0 for no limit"`
+	GlobalStreams     int     `yaml:"global_streams" usage:"archives streamed at once by the server, 0 for no limit"`
+	By                string  `yaml:"by" usage:"client identity: ip, key (signing key ID) or tenant"`
+	// Header holding the client IP set by a trusted reverse proxy, the last address is used: the one
+	// appended by the proxy, the previous ones are given by the client
+	ClientIPHeader string `yaml:"client_ip_header" usage:"header holding the client IP when behind a reverse proxy, e.g. X-Forwarded-For"`
+	// Above GlobalStreams, requests wait in a queue instead of getting a 429
+	QueueSize    int           `yaml:"queue_size" usage:"requests waiting for a stream slot above global_streams, 0 to reject them"`
+	QueueMaxWait time.Duration `yaml:"queue_max_wait" usage:"maximum time a request waits in the queue"`
+}
+
+// Queued requests wait this long when no QueueMaxWait is set
+const defaultQueueMaxWait = 30 * time.Second
+
+func (o RateLimitOptions) queued() bool {
+	return o.GlobalStreams > 0 && o.QueueSize > 0
+}
+
+func (o RateLimitOptions) enabled() bool {
+	return o.RequestsPerSecond > 0 || o.ConcurrentStreams > 0 || o.GlobalStreams > 0
+}
+
+type clientLimit struct {
+	// token bucket, refilled at RequestsPerSecond up to Burst
+	tokens    float64
+	updatedAt time.Time
+	streams   int
+}
+
+type rateLimiter struct {
+	options RateLimitOptions
+	burst   float64
+
+	mu       sync.Mutex
+	clients  map[string]*clientLimit
+	streams  int
+	prunedAt time.Time
+}
+
+func newRateLimiter(options RateLimitOptions) *rateLimiter {
+	burst := float64(options.Burst)
+	if burst < 1 {
+		burst = math.Max(1, math.Ceil(options.RequestsPerSecond))
+	}
+
+	return &rateLimiter{options: options, burst: burst, clients: make(map[string]*clientLimit), prunedAt: time.Now()}
+}
+
+// Takes a request token and a stream slot of the client. It returns the release function of the slot,
+// or the delay after which the client should retry.
+func (l *rateLimiter) acquire(client string) (func(), time.Duration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.prune(now)
+
+	c := l.clients[client]
+	if c == nil {
+		c = &clientLimit{tokens: l.burst, updatedAt: now}
+		l.clients[client] = c
+	}
+
+	if l.options.RequestsPerSecond > 0 {
+		c.tokens = math.Min(l.burst, c.tokens+now.Sub(c.updatedAt).Seconds()*l.options.RequestsPerSecond)
+		c.updatedAt = now
+
+		if c.tokens < 1 {
+			wait := time.Duration((1 - c.tokens) / l.options.RequestsPerSecond * float64(time.Second))
+			return nil, wait, false
+		}
+	}
+
+	if l.options.ConcurrentStreams > 0 && c.streams >= l.options.ConcurrentStreams {
+		return nil, time.Second, false
+	}
+
+	// the admission queue enforces it when enabled
+	if l.options.GlobalStreams > 0 && !l.options.queued() && l.streams >= l.options.GlobalStreams {
+		return nil, time.Second, false
+	}
+
+	if l.options.RequestsPerSecond > 0 {
+		c.tokens--
+	}
+	c.streams++
+	l.streams++
+
+	var once sync.Once
+	release := func() {
+		once.Do(func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+
+			c.streams--
+			l.streams--
+		})
+	}
+
+	return release, 0, true
+}
+
+// Forgets the clients having a full bucket and no stream
+func (l *rateLimiter) prune(now time.Time) {
+	if now.Sub(l.prunedAt) < rateLimitPruneInterval {
+		return
+	}
+	l.prunedAt = now
+
+	for client, c := range l.clients {
+		refilled := c.tokens + now.Sub(c.updatedAt).Seconds()*l.options.RequestsPerSecond
+		if c.streams == 0 && (l.options.RequestsPerSecond <= 0 || refilled >= l.burst) {
+			delete(l.clients, client)
+		}
+	}
+}
+
+type rateLimitClientKey struct{}
+
+// Client of the request identified by rateLimited, its IP when it went through no rate limit
+func (s *Server) rateLimitedClient(req *http.Request) string {
+	if client, ok := req.Context().Value(rateLimitClientKey{}).(string); ok {
+		return client
+	}
+
+	return "ip:" + s.options.RateLimit.clientIP(req)
+}
+
+// Bodies of the POST requests read to check their signature before the rate limit, the larger ones
+// are limited by IP
+const maxKeyedBodyBytes = 1 << 20
+
+// Identifies the client of the request. The key ID is only used once the signature is checked,
+// so that a client can't spend the limits of another key, the other requests are limited by IP.
+// The returned request is the one to handle, it records that its signature was checked.
+func (s *Server) rateLimitClient(req *http.Request) (string, *http.Request) {
+	o := s.options.RateLimit
+	switch o.By {
+	case "tenant":
+		tenant := requestTenant(req)
+		if tenant == nil {
+			tenant = s.authenticatedTokenTenant(req)
+		}
+		return "tenant:" + tenant.Name(), req
+	case "key":
+		if kid := s.authenticatedKeyId(req); kid != "" {
+			return "key:" + requestTenant(req).Name() + ":" + kid, withVerifiedSignature(req)
+		}
+	}
+
+	return "ip:" + o.clientIP(req), req
+}
+
+// Key ID of the request when its signature is valid. The POST body is read to check it, up to
+// maxKeyedBodyBytes, and put back for the handler.
+func (s *Server) authenticatedKeyId(req *http.Request) string {
+	if !s.mustValidateRequestSignature() {
+		return ""
+	}
+
+	tenant := requestTenant(req)
+	switch req.Method {
+	case http.MethodGet:
+		if _, _, kid := extractSignatureAndExpiresFromQueryString(req); kid != "" && s.validateGetRequestSignature(req, tenant) {
+			return kid
+		}
+	case http.MethodPost:
+		_, _, kid := extractSignatureAndExpiresFromHeaders(req)
+		if kid == "" {
+			return ""
+		}
+
+		// unlike http.MaxBytesReader, it doesn't drop the byte over the limit, and a read error is
+		// given again to the handler by the original body
+		body, err := io.ReadAll(io.LimitReader(req.Body, maxKeyedBodyBytes+1))
+		req.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), req.Body), req.Body}
+
+		if err == nil && len(body) <= maxKeyedBodyBytes && s.validatePostRequestSignature(req, body, tenant) {
+			return kid
+		}
+	}
+
+	return ""
+}
+
+// Tenant selected by the bearer token of the request when the token is valid
+func (s *Server) authenticatedTokenTenant(req *http.Request) *Tenant {
+	token := bearerToken(req)
+	if token == "" || s.options.TokenVerifier == nil {
+		return nil
+	}
+
+	claims, err := s.options.TokenVerifier.verify(token)
+	if err != nil {
+		return nil
+	}
+
+	tenant, _ := s.tokenTenant(claims, nil)
+	return tenant
+}
+
+func (o RateLimitOptions) clientIP(req *http.Request) string {
+	if o.ClientIPHeader != "" {
+		if values := req.Header.Values(o.ClientIPHeader); len(values) > 0 {
+			forwarded := values[len(values)-1]
+			return strings.TrimSpace(forwarded[strings.LastIndex(forwarded, ",")+1:])
+		}
+	}
+
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+
+	return host
+}
+
+// Answers 429 with Retry-After to the requests over the limits, the stream slot is held until the
+// archive is sent
+func (s *Server) rateLimited(next http.HandlerFunc) http.HandlerFunc {
+	if s.limiter == nil {
+		return next
+	}
+
+	return func(w http.ResponseWriter, req *http.Request) {
+		client, req := s.rateLimitClient(req)
+		release, retryAfter, ok := s.limiter.acquire(client)
+		if !ok {
+			tooManyRequests(w, retryAfter)
+			return
+		}
+
+		defer release()
+		next(w, req.WithContext(context.WithValue(req.Context(), rateLimitClientKey{}, client)))
+	}
+}
+
+// Limits the /zip/{id}/events requests of each IP to the request rate, they are not authorized
+func (s *Server) eventsRateLimited(next http.HandlerFunc) http.HandlerFunc {
+	if s.eventsLimiter == nil {
+		return next
+	}
+
+	return func(w http.ResponseWriter, req *http.Request) {
+		release, retryAfter, ok := s.eventsLimiter.acquire("ip:" + s.options.RateLimit.clientIP(req))
+		if !ok {
+			tooManyRequests(w, retryAfter)
+			return
+		}
+
+		// only the rate is limited, not the subscriptions at once
+		release()
+		next(w, req)
+	}
+}
+
+func tooManyRequests(w http.ResponseWriter, retryAfter time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	http.Error(w, "too many requests", http.StatusTooManyRequests)
+}
@@ -1,9 +1,11 @@
 package zipfly
 
 import (
+	"context"
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/hex"
+	"fmt"
 	"net/http"
 	"net/url"
 	"strconv"
@@ -20,35 +22,90 @@ func validateExpiration(expires string) bool {
 }
 
 func validateHMAC(message, signature, key []byte) bool {
-	mac := hmac.New(sha256.New, key)
-	mac.Write(message)
-	hexMac := hex.EncodeToString(mac.Sum(nil))
+	hexMac := signHMAC(message, key)
 
 	return hmac.Equal(signature, []byte(hexMac))
 }
 
-func extractSignatureAndExpiresFromHeaders(req *http.Request) (string, string) {
+func signHMAC(message, key []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(message)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func extractSignatureAndExpiresFromHeaders(req *http.Request) (string, string, string) {
 	signature := req.Header.Get("x-zipfly-signature")
 	expires := req.Header.Get("x-zipfly-expires")
-	return signature, expires
+	kid := req.Header.Get("x-zipfly-key-id")
+	return signature, expires, kid
 }
 
-func extractSignatureAndExpiresFromQueryString(req *http.Request) (string, string) {
+func extractSignatureAndExpiresFromQueryString(req *http.Request) (string, string, string) {
 	query := req.URL.Query()
 	if query["signature"] == nil || query["expires"] == nil {
-		return "", ""
+		return "", "", ""
 	}
 
-	return query["signature"][0], query["expires"][0]
+	return query["signature"][0], query["expires"][0], query.Get("kid")
 }
 
 func (s *Server) mustValidateRequestSignature() bool {
 	return s.options.ValidateSignature || s.environment == "production"
 }
 
-func (s *Server) validateGetRequestSignature(req *http.Request) bool {
+// Returns the claims of the bearer token, nil when the request is signed instead, and the tenant of the
+// request, which a token can select
+func (s *Server) authorizeGetRequest(req *http.Request, tenant *Tenant) (*zipClaims, *Tenant, bool) {
+	if token := bearerToken(req); token != "" && s.options.TokenVerifier != nil {
+		return s.verifyToken(token, tenant)
+	}
+
+	return nil, tenant, s.validateGetRequestSignature(req, tenant)
+}
+
+func (s *Server) authorizePostRequest(req *http.Request, body []byte, tenant *Tenant) (*zipClaims, *Tenant, bool) {
+	if token := bearerToken(req); token != "" && s.options.TokenVerifier != nil {
+		return s.verifyToken(token, tenant)
+	}
+
+	return nil, tenant, s.validatePostRequestSignature(req, body, tenant)
+}
+
+func (s *Server) verifyToken(token string, tenant *Tenant) (*zipClaims, *Tenant, bool) {
+	claims, err := s.options.TokenVerifier.verify(token)
+	if err != nil {
+		fmt.Println("Invalid token:", err.Error())
+		return nil, nil, false
+	}
+
+	tenant, ok := s.tokenTenant(claims, tenant)
+	if !ok {
+		fmt.Println("Invalid token: tenant mismatch")
+		return nil, nil, false
+	}
+
+	return claims, tenant, true
+}
+
+type verifiedSignatureKey struct{}
+
+// Records that the signature of the request was checked for its tenant, by the rate limit
+func withVerifiedSignature(req *http.Request) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), verifiedSignatureKey{}, requestTenant(req)))
+}
+
+func signatureVerified(req *http.Request, tenant *Tenant) bool {
+	verified, ok := req.Context().Value(verifiedSignatureKey{}).(*Tenant)
+	return ok && verified == tenant
+}
+
+func (s *Server) validateGetRequestSignature(req *http.Request, tenant *Tenant) bool {
+	if signatureVerified(req, tenant) {
+		return true
+	}
+
 	if s.mustValidateRequestSignature() {
-		signature, expires := extractSignatureAndExpiresFromQueryString(req)
+		signature, expires, kid := extractSignatureAndExpiresFromQueryString(req)
 
 		query := req.URL.Query()
 		query.Del("signature")
@@ -56,25 +113,29 @@ func (s *Server) validateGetRequestSignature(req *http.Request) bool {
 		u.Path = req.URL.Path
 		u.RawQuery = query.Encode()
 
-		return s.validateSignature(signature, expires, u.String())
+		return s.validateSignature(tenant, signature, expires, kid, u.String())
 	}
 
 	return true
 }
 
-func (s *Server) validatePostRequestSignature(req *http.Request, body []byte) bool {
+func (s *Server) validatePostRequestSignature(req *http.Request, body []byte, tenant *Tenant) bool {
+	if signatureVerified(req, tenant) {
+		return true
+	}
+
 	if s.mustValidateRequestSignature() {
-		signature, expires := extractSignatureAndExpiresFromHeaders(req)
+		signature, expires, kid := extractSignatureAndExpiresFromHeaders(req)
 
 		message := expires + ":" + string(body)
 
-		return s.validateSignature(signature, expires, message)
+		return s.validateSignature(tenant, signature, expires, kid, message)
 	}
 
 	return true
 }
 
-func (s *Server) validateSignature(signature, expires, message string) bool {
+func (s *Server) validateSignature(tenant *Tenant, signature, expires, kid, message string) bool {
 	if signature == "" || expires == "" {
 		return false
 	}
@@ -83,5 +144,44 @@ func (s *Server) validateSignature(signature, expires, message string) bool {
 		return false
 	}
 
-	return validateHMAC([]byte(message), []byte(signature), []byte(s.options.SigningSecret))
+	key, ok := s.signingKey(tenant, kid)
+	if !ok {
+		return false
+	}
+
+	return key.verify([]byte(message), []byte(signature))
+}
+
+// Signatures without key ID use the SigningSecret, the others a key of the SigningKeys.
+// The requests of a tenant only use its own keys.
+func (s *Server) signingKey(tenant *Tenant, kid string) (SigningKey, bool) {
+	secret, keys := s.signingKeys(tenant)
+	if kid == "" {
+		return SigningKey{Secret: secret}, secret != ""
+	}
+
+	if keys == nil {
+		return SigningKey{}, false
+	}
+
+	return keys.key(kid)
+}
+
+// Key used to sign the requests sent by the server: the SigningSecret when set, else the newest valid key
+func (s *Server) outgoingSigningKey(tenant *Tenant) (string, string) {
+	secret, keys := s.signingKeys(tenant)
+	if secret != "" || keys == nil {
+		return "", secret
+	}
+
+	kid, secret, _ := keys.current()
+	return kid, secret
+}
+
+func (s *Server) signingKeys(tenant *Tenant) (string, *KeySet) {
+	if tenant != nil {
+		return tenant.SigningSecret, tenant.SigningKeys
+	}
+
+	return s.options.SigningSecret, s.options.SigningKeys
 }
@@ -1,6 +1,7 @@
 package zipfly
 
 import (
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
@@ -8,54 +9,143 @@ import (
 	"io"
 	"net/http"
 
-	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type ServerOptions struct {
 	ValidateSignature bool
 	SigningSecret     string
 	PublicUrl         string
+	// Named keys, used by signatures carrying a key ID
+	SigningKeys *KeySet
+	// GET source manifests must carry a valid signature, unless pinned by the manifest_sha256 param
+	RequireManifestSignature bool
+	// Verifies the JWT bearer tokens accepted instead of a signature, can be nil
+	TokenVerifier *TokenVerifier
+	// Records the uses of limited-use links, defaults to an in-memory store
+	NonceStore NonceStore
+	// CORS allowed origins, defaults to "*"
+	CorsAllowedOrigins []string
+	Upstream           UpstreamOptions
+	// Client fetching the manifests and files instead of one built from Upstream, its redirects are
+	// also checked against the allowed hosts of the tenant
+	HTTPClient *http.Client
+	Webhook    WebhookOptions
+	RateLimit  RateLimitOptions
+	Limits     LimitsOptions
+	Bandwidth  BandwidthOptions
+	// Sanitization of the entry paths, defaults to NameWindowsSafe
+	NamePolicy NamePolicy
+	// Tenants by name, each with its own signing keys and policy
+	Tenants map[string]*Tenant
 }
 
 type Server struct {
 	environment string
 	options     ServerOptions
 	router      *mux.Router
+	client      *http.Client
+	streams     *streamRegistry
+	cors        func(http.Handler) http.Handler
+	// nil when no rate limit is set
+	limiter *rateLimiter
+	// nil when no request rate is set
+	eventsLimiter *rateLimiter
+	// nil when the requests above the global streams limit are not queued
+	queue *admissionQueue
+	drain *drainState
+	// shared by all the streams, nil without global rate
+	bandwidth *bandwidthLimiter
+	webhooks  *webhookDeliveries
+	metrics   *archiveMetrics
 }
 
 type zipPayload struct {
 	Filename  string `json:"filename"`
 	Files     []File `json:"files"`
 	Signature string `json:"signature,omitempty"`
+	// Key ID of the signature, the SigningSecret is used without it
+	KeyId string `json:"kid,omitempty"`
+	// Notified of the archive result when set
+	CallbackUrl string `json:"callback_url,omitempty"`
+	// What to do with files having the same path, defaults to DuplicateRename
+	OnDuplicate DuplicatePolicy `json:"on_duplicate,omitempty"`
+	// What to do with files that can't be fetched, defaults to ErrorAbort
+	OnError     ErrorPolicy       `json:"on_error,omitempty"`
+	ErrorReport ErrorReportFormat `json:"error_report,omitempty"`
+	// Appends a SHA256SUMS or manifest.json file to the archive
+	Checksums ChecksumFormat `json:"checksums,omitempty"`
+	// Encoding of the names in the archive, for the old extractors
+	NameEncoding NameEncoding `json:"name_encoding,omitempty"`
+	// Comment of the archive
+	Comment string `json:"comment,omitempty"`
+	// Makes the request a limited-use link
+	Nonce   string `json:"nonce,omitempty"`
+	MaxUses int    `json:"max_uses,omitempty"`
+	// Lower the limits of the server for this archive
+	MaxBytes      int64 `json:"max_bytes,omitempty"`
+	MaxEntryBytes int64 `json:"max_entry_bytes,omitempty"`
+	MaxEntries    int   `json:"max_entries,omitempty"`
+	// Lowers the download speed of the archive
+	MaxBytesPerSecond int64 `json:"max_bytes_per_second,omitempty"`
+
+	// Limits set by the request authorization and the tenant, 0 for none
+	maxBytes          int64
+	maxEntryBytes     int64
+	maxEntries        int
+	maxBytesPerSecond int64
+	tenant            *Tenant
 }
 
 type File struct {
 	Url      string `json:"url"`
 	Filename string `json:"filename"`
 	Compress bool   `json:"compress,omitempty"`
+	// Left out of the archive when it can't be fetched, whatever the on_error policy
+	Optional bool `json:"optional,omitempty"`
+	// "symlink" for a link to Target, without Url
+	Type   string `json:"type,omitempty"`
+	Target string `json:"target,omitempty"`
+	// Unix permissions in octal, e.g. "0755"
+	Mode    string `json:"mode,omitempty"`
+	Comment string `json:"comment,omitempty"`
+	// Written in an Info-ZIP Unix extra field when set
+	Uid *int `json:"uid,omitempty"`
+	Gid *int `json:"gid,omitempty"`
 }
 
-func fetch(sourceUrl string) (*zipPayload, error) {
-	fmt.Println("Fetching files to zip from", sourceUrl)
-	resp, err := http.Get(sourceUrl)
-
+func (s *Server) fetch(ctx context.Context, sourceUrl string) (manifest []byte, err error) {
+	ctx, span := tracer().Start(ctx, "fetchManifest")
+	span.SetAttributes(attribute.String("zipfly.source_url", spanUrl(sourceUrl)))
+	defer func() {
+		if err != nil {
+			recordSpanError(span, err)
+		}
+		span.End()
+	}()
+
+	tenant, _ := ctx.Value(tenantContextKey{}).(*Tenant)
+	logWithTenant(tenant, "Fetching files to zip from", sourceUrl)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, sourceUrl, nil)
 	if err != nil {
 		return nil, err
 	}
 
-	if resp.StatusCode != http.StatusOK {
-		return nil, errors.New("couldn't fetch from URL")
+	resp, err := s.client.Do(req)
+
+	if err != nil {
+		return nil, err
 	}
 
 	defer resp.Body.Close()
 
-	bodyBytes, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, err
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("couldn't fetch from URL")
 	}
 
-	return UnmarshalPayload(bodyBytes)
+	return io.ReadAll(resp.Body)
 }
 
 func UnmarshalPayload(payload []byte) (*zipPayload, error) {
@@ -70,21 +160,81 @@ func UnmarshalPayload(payload []byte) (*zipPayload, error) {
 
 func NewServer(env string, options ServerOptions) *Server {
 	r := mux.NewRouter()
+	r.Use(nameSpanAfterRoute)
 
-	server := Server{environment: env, options: options, router: r}
+	if len(options.CorsAllowedOrigins) == 0 {
+		options.CorsAllowedOrigins = []string{"*"}
+	}
 
-	r.HandleFunc("/zip", server.HandleGetStreamZip).Methods("GET")
-	r.HandleFunc("/zip", server.HandlePostStreamZip).Methods("POST")
+	if options.NonceStore == nil {
+		options.NonceStore = NewMemoryNonceStore()
+	}
+
+	options.Webhook = options.Webhook.withDefaults()
+
+	tenants := make(map[string]*Tenant, len(options.Tenants))
+	for name, tenant := range options.Tenants {
+		t := *tenant
+		t.name = name
+		if len(t.CorsAllowedOrigins) == 0 {
+			t.CorsAllowedOrigins = options.CorsAllowedOrigins
+		}
+		t.cors = corsHandler(t.CorsAllowedOrigins)
+		tenants[name] = &t
+	}
+	options.Tenants = tenants
+
+	server := Server{
+		environment: env,
+		options:     options,
+		router:      r,
+		client:      options.HTTPClient,
+		streams:     newStreamRegistry(),
+		drain:       newDrainState(),
+		metrics:     newArchiveMetrics(),
+		cors:        corsHandler(options.CorsAllowedOrigins),
+	}
+
+	if server.client == nil {
+		server.client = newUpstreamClient(options.Upstream, nil)
+	}
+	server.client = checkTenantRedirects(server.client)
+	server.webhooks = newWebhookDeliveries(options.Upstream, options.Webhook)
+
+	if options.Bandwidth.GlobalBytesPerSecond > 0 {
+		server.bandwidth = newBandwidthLimiter(options.Bandwidth.GlobalBytesPerSecond)
+	}
+
+	if options.RateLimit.enabled() {
+		server.limiter = newRateLimiter(options.RateLimit)
+	}
+
+	if options.RateLimit.RequestsPerSecond > 0 {
+		server.eventsLimiter = newRateLimiter(RateLimitOptions{RequestsPerSecond: options.RateLimit.RequestsPerSecond, Burst: options.RateLimit.Burst})
+	}
+
+	if options.RateLimit.queued() {
+		if options.RateLimit.QueueMaxWait <= 0 {
+			options.RateLimit.QueueMaxWait = defaultQueueMaxWait
+		}
+		server.queue = newAdmissionQueue(options.RateLimit.GlobalStreams, options.RateLimit.QueueSize, options.RateLimit.QueueMaxWait)
+	}
+
+	// the tenant routes are also served under the /t/{tenant} prefix
+	for _, router := range []*mux.Router{r, r.PathPrefix("/t/{tenant}").Subrouter()} {
+		router.HandleFunc("/zip", server.drainable(server.rateLimited(server.HandleGetStreamZip))).Methods("GET")
+		router.HandleFunc("/zip", server.drainable(server.rateLimited(server.HandlePostStreamZip))).Methods("POST")
+		router.HandleFunc("/zip/{id}/events", server.eventsRateLimited(server.HandleStreamEvents)).Methods("GET")
+	}
+	r.HandleFunc("/metrics", server.HandleMetrics).Methods("GET")
 	r.HandleFunc("/healthz", server.HealthCheck).Methods("GET")
+	r.HandleFunc("/readyz", server.ReadinessCheck).Methods("GET")
 
 	return &server
 }
 
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	originsOk := handlers.AllowedOrigins([]string{"*"})
-	headersOk := handlers.AllowedHeaders([]string{"Content-Type", "X-Requested-With", "*"})
-	methodsOk := handlers.AllowedMethods([]string{"GET", "HEAD", "POST", "PUT", "OPTIONS"})
-	handlers.CORS(originsOk, headersOk, methodsOk)(s.router).ServeHTTP(w, r)
+	traceRequest(w, r, http.HandlerFunc(s.serveTenant))
 }
 
 func (s *Server) HealthCheck(w http.ResponseWriter, req *http.Request) {
@@ -93,19 +243,42 @@ func (s *Server) HealthCheck(w http.ResponseWriter, req *http.Request) {
 }
 
 func (s *Server) HandleGetStreamZip(w http.ResponseWriter, req *http.Request) {
-	if !s.validateGetRequestSignature(req) {
+	claims, tenant, ok := s.authorizeGetRequest(req, requestTenant(req))
+	if !ok {
 		http.Error(w, "invalid signature", http.StatusForbidden)
 		return
 	}
+	req = s.withTokenTenant(w, req, tenant)
+
+	release, ok := s.admit(w, req)
+	if !ok {
+		return
+	}
+	defer release()
+
+	payload, err := s.extractZipPayloadFromQueryString(req, claims, tenant)
+
+	if errors.Is(err, errTokenNotAllowed) || errors.Is(err, errManifestNotAllowed) || errors.Is(err, errHostNotAllowed) {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
 
-	payload, err := s.extractZipPayloadFromQueryString(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
+	use, err := linkUseFromQueryString(req, claims)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	s.streamZip(w, payload)
+	if !s.useLink(w, use, tenant) {
+		return
+	}
+
+	s.streamZip(w, req, payload)
 }
 
 func (s *Server) HandlePostStreamZip(w http.ResponseWriter, req *http.Request) {
@@ -117,10 +290,18 @@ func (s *Server) HandlePostStreamZip(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	if !s.validatePostRequestSignature(req, body) {
+	claims, tenant, ok := s.authorizePostRequest(req, body, requestTenant(req))
+	if !ok {
 		http.Error(w, "invalid signature", http.StatusForbidden)
 		return
 	}
+	req = s.withTokenTenant(w, req, tenant)
+
+	release, ok := s.admit(w, req)
+	if !ok {
+		return
+	}
+	defer release()
 
 	payload, err := s.zipPayloadFromBody(body)
 
@@ -129,10 +310,31 @@ func (s *Server) HandlePostStreamZip(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	s.streamZip(w, payload)
+	if claims != nil {
+		if err := claims.authorizeManifest(body, true); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+
+		claims.apply(payload, "")
+	}
+
+	tenant.apply(payload)
+
+	use, err := linkUseFromBody(req, payload, claims)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if !s.useLink(w, use, tenant) {
+		return
+	}
+
+	s.streamZip(w, req, payload)
 }
 
-func (s *Server) extractZipPayloadFromQueryString(req *http.Request) (*zipPayload, error) {
+func (s *Server) extractZipPayloadFromQueryString(req *http.Request, claims *zipClaims, tenant *Tenant) (*zipPayload, error) {
 	query := req.URL.Query()
 	if query["source"] == nil || query["source"][0] == "" {
 		return nil, errors.New("missing source url")
@@ -143,15 +345,46 @@ func (s *Server) extractZipPayloadFromQueryString(req *http.Request) (*zipPayloa
 		return nil, errors.New("invalid source url")
 	}
 
-	payload, err := fetch(string(decodedSourceUrl))
+	if claims != nil {
+		if err := claims.authorizeSource(string(decodedSourceUrl)); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tenant.checkHost(string(decodedSourceUrl)); err != nil {
+		return nil, err
+	}
+
+	manifest, err := s.fetch(req.Context(), string(decodedSourceUrl))
 	if err != nil {
 		return nil, err
 	}
 
-	if query["filename"] != nil {
+	if claims != nil {
+		if err := claims.authorizeManifest(manifest, false); err != nil {
+			return nil, err
+		}
+	}
+
+	payload, err := UnmarshalPayload(manifest)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.verifyManifest(query, manifest, payload, claims, tenant); err != nil {
+		return nil, err
+	}
+
+	if claims != nil {
+		if err := claims.apply(payload, query.Get("filename")); err != nil {
+			return nil, err
+		}
+	} else if query["filename"] != nil {
 		payload.Filename = query["filename"][0]
 	}
 
+	tenant.apply(payload)
+
 	return payload, nil
 }
 
@@ -164,34 +397,142 @@ func (s *Server) zipPayloadFromBody(body []byte) (*zipPayload, error) {
 	return payload, nil
 }
 
-func (s *Server) streamZip(w http.ResponseWriter, payload *zipPayload) {
-	if payload.Filename == "" {
-		payload.Filename = "archive.zip"
+func (s *Server) streamZip(w http.ResponseWriter, req *http.Request, payload *zipPayload) {
+	payload.Filename = ArchiveFilename(payload.Filename)
+
+	if err := validateCallbackUrl(payload.CallbackUrl); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
 
-	fmt.Println("Creating zip:", payload.Filename)
+	if payload.CallbackUrl != "" {
+		if err := payload.tenant.checkHost(payload.CallbackUrl); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+	}
+
+	for _, file := range payload.Files {
+		if file.Type == FileTypeSymlink {
+			continue
+		}
+
+		if err := payload.tenant.checkHost(file.Url); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+	}
 
-	zipStreamer, err := NewZipStreamer(payload.Files)
+	payload.lowerLimits(s.options.Limits)
+	payload.maxBytesPerSecond = lowerLimit(lowerLimit(payload.maxBytesPerSecond, s.options.Bandwidth.StreamBytesPerSecond), payload.MaxBytesPerSecond)
+
+	progress := s.streams.start(requestedStreamId(req))
+	w.Header().Set(streamIdHeader, progress.id)
+
+	s.metrics.start(payload.tenant)
+	logWithTenant(payload.tenant, "Creating zip:", payload.Filename, "stream:", progress.id)
+	progress.begin(payload.Filename, len(payload.Files))
+
+	zipStreamer, err := NewZipStreamerWithOptions(payload.Files, StreamerOptions{
+		NamePolicy:    s.options.NamePolicy,
+		OnDuplicate:   payload.OnDuplicate,
+		OnError:       payload.OnError,
+		ErrorReport:   payload.ErrorReport,
+		Checksums:     payload.Checksums,
+		NameEncoding:  payload.NameEncoding,
+		Comment:       payload.Comment,
+		MaxSpoolBytes: s.options.Limits.MaxSpoolBytes,
+	})
 	if err != nil {
-		fmt.Println("Error while parsing source files for", payload.Filename, ":", err.Error())
+		logWithTenant(payload.tenant, "Error while parsing source files for", payload.Filename, ":", err.Error())
+		s.finishStream(payload, progress, err)
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
+	if payload.maxEntries > 0 && len(zipStreamer.Entries) > payload.maxEntries {
+		err := fmt.Errorf("too many files: %d, the limit is %d", len(zipStreamer.Entries), payload.maxEntries)
+		s.finishStream(payload, progress, err)
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	if len(zipStreamer.Renamed) > 0 {
+		for _, change := range zipStreamer.Renamed {
+			logWithTenant(payload.tenant, "Renamed", change.Original, "to", change.Sanitized, "in", payload.Filename)
+		}
+		progress.publish("renamed", zipStreamer.Renamed)
+	}
+
+	for _, skipped := range zipStreamer.Skipped {
+		logWithTenant(payload.tenant, "Skipped duplicate", skipped, "in", payload.Filename)
+	}
+
+	for _, entry := range zipStreamer.Entries {
+		entry.Client = s.client
+		entry.MaxBytes = payload.maxEntryBytes
+	}
+
+	if s.options.Limits.SizeCheck && (payload.maxBytes > 0 || payload.maxEntryBytes > 0) {
+		if err := s.checkSizes(req.Context(), zipStreamer.Entries, payload.maxBytes, payload.maxEntryBytes); err != nil {
+			s.finishStream(payload, progress, err)
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+	}
+
+	span := trace.SpanFromContext(req.Context())
+	span.SetAttributes(attribute.String("zipfly.filename", payload.Filename), attribute.Int("zipfly.entries", len(zipStreamer.Entries)))
+
+	zipStreamer.OnProgress = progress.onProgress
+
 	// need to write the header before bytes
 	w.Header().Set("Content-Type", "application/zip")
-	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", payload.Filename))
+	w.Header().Set("Content-Disposition", contentDisposition(payload.Filename))
 	w.WriteHeader(http.StatusOK)
-	err = zipStreamer.StreamFiles(w)
+	var output io.Writer = progress.writer(s.throttle(req.Context(), w, payload.maxBytesPerSecond))
+	if payload.maxBytes > 0 {
+		output = &limitedWriter{w: output, remaining: payload.maxBytes}
+	}
+
+	err = zipStreamer.StreamFilesContext(req.Context(), output)
+	s.finishStream(payload, progress, err)
 
-	fmt.Println("Done streaming zip:", payload.Filename)
+	if errors.Is(err, ErrClientAborted) {
+		logWithTenant(payload.tenant, "Client aborted zip:", payload.Filename)
+		span.SetAttributes(attribute.Bool("zipfly.aborted", true))
+		return
+	}
+
+	logWithTenant(payload.tenant, "Done streaming zip:", payload.Filename)
+
+	for _, failure := range zipStreamer.Failed {
+		logWithTenant(payload.tenant, "Skipped failed file", failure.Path, "in", payload.Filename, ":", failure.Error)
+	}
 
 	if err != nil {
-		fmt.Println("Streaming error for", payload.Filename, ":", err.Error())
+		logWithTenant(payload.tenant, "Streaming error for", payload.Filename, ":", err.Error())
+		recordSpanError(span, err)
 		closeForError(w)
 	}
 }
 
+// Publishes the result of the archive to its subscribers, metrics and callback
+func (s *Server) finishStream(payload *zipPayload, progress *streamProgress, err error) {
+	result := progress.finish(s.streams, err)
+	s.metrics.finish(payload.tenant, result)
+	s.notifyCallback(payload, progress.id, result)
+}
+
+// The client can choose the stream ID, to subscribe to its events before the download starts
+func requestedStreamId(req *http.Request) string {
+	if id := req.URL.Query().Get("stream_id"); id != "" {
+		return id
+	}
+
+	return req.Header.Get(streamIdHeader)
+}
+
 // Close the connection so the client gets an error instead of 200 with an invalid file
 func closeForError(w http.ResponseWriter) {
 	hj, ok := w.(http.Hijacker)
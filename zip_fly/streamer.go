@@ -3,43 +3,212 @@ package zipfly
 import (
 	"archive/zip"
 	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
+	"math"
+	"path"
+	"strings"
 	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type ZipStreamer struct {
 	Entries []*Entry
+	// Called when each entry starts and once it's written, can be nil
+	OnProgress func(ProgressEvent)
+	// Entry paths changed by the name policy or the duplicate policy
+	Renamed []NameChange
+	// Paths of the files left out by the duplicate policy
+	Skipped []string
+	// Defaults to ErrorAbort, optional entries are skipped anyway
+	OnError     ErrorPolicy
+	ErrorReport ErrorReportFormat
+	// Entries skipped while streaming
+	Failed []EntryFailure
+	// Appends a file of checksums when set
+	Checksums ChecksumFormat
+	// Encoding of the entry names in the headers, defaults to NameUtf8
+	NameEncoding NameEncoding
+	// Comment of the archive
+	Comment string
+	// Checksums of the entries written, computed when Checksums is set
+	EntryChecksums []EntryChecksum
+	// Files that may be left out are fetched in full before being added, and left out above this
+	// size, defaults to 1 GiB
+	MaxSpoolBytes int64
+}
+
+// StreamerOptions tells how the entries are built from the manifest files
+type StreamerOptions struct {
+	// Defaults to NameWindowsSafe
+	NamePolicy NamePolicy
+	// Defaults to DuplicateRename
+	OnDuplicate DuplicatePolicy
+	// Defaults to ErrorAbort
+	OnError     ErrorPolicy
+	ErrorReport ErrorReportFormat
+	Checksums   ChecksumFormat
+	// Defaults to NameUtf8
+	NameEncoding NameEncoding
+	Comment      string
+	// Defaults to 1 GiB
+	MaxSpoolBytes int64
+}
+
+// ProgressEvent reports the streaming progress of an archive
+type ProgressEvent struct {
+	Entry *Entry
+	// Index of the entry in the archive
+	Index int
+	// False when the entry starts, true once it's fully written
+	Done bool
+	// Uncompressed bytes of the entry written so far
+	EntryBytes int64
+	// Bytes of the archive written so far
+	ArchiveBytes int64
+	// Set when the entry failed and was skipped
+	Err error
 }
 
 func NewZipStreamer(files []File) (*ZipStreamer, error) {
+	return NewZipStreamerWithOptions(files, StreamerOptions{})
+}
+
+func NewZipStreamerWithOptions(files []File, options StreamerOptions) (*ZipStreamer, error) {
 	if len(files) == 0 {
 		return nil, errors.New("no file to zip")
 	}
 
-	entries := make([]*Entry, 0)
+	if !options.OnDuplicate.valid() {
+		return nil, fmt.Errorf("unknown duplicate policy %q", options.OnDuplicate)
+	}
+
+	if !options.OnError.valid() || !options.ErrorReport.valid() {
+		return nil, fmt.Errorf("unknown error policy %q or report format %q", options.OnError, options.ErrorReport)
+	}
+
+	if !options.Checksums.valid() {
+		return nil, fmt.Errorf("unknown checksums format %q", options.Checksums)
+	}
+
+	if !options.NameEncoding.valid() {
+		return nil, fmt.Errorf("unknown name encoding %q", options.NameEncoding)
+	}
+
+	if len(options.Comment) > math.MaxUint16 {
+		return nil, errCommentTooLong
+	}
+
+	z := ZipStreamer{Entries: make([]*Entry, 0), OnError: options.OnError, ErrorReport: options.ErrorReport, Checksums: options.Checksums, NameEncoding: options.NameEncoding, Comment: options.Comment, MaxSpoolBytes: options.MaxSpoolBytes}
+	paths := newEntryPaths(options.NameEncoding)
 	for _, file := range files {
-		entry, err := NewEntry(file.Url, file.Filename, file.Compress)
+		zipPath, err := options.NamePolicy.sanitize(file.Filename)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := options.NameEncoding.checkName(zipPath); err != nil {
+			return nil, err
+		}
+
+		entry, err := newFileEntry(file, zipPath)
 		if err != nil {
 			return nil, err
 		}
 
-		entries = append(entries, entry)
+		if existing := paths.get(entry.ZipPath); existing != nil {
+			switch options.OnDuplicate {
+			case DuplicateError:
+				return nil, fmt.Errorf("duplicate zip filename: %s", entry.ZipPath)
+			case DuplicateSkip:
+				z.Skipped = append(z.Skipped, file.Filename)
+				continue
+			case DuplicateLastWins:
+				z.Skipped = append(z.Skipped, existing.ZipPath)
+				z.Entries = removeEntry(z.Entries, existing)
+			default:
+				entry.ZipPath = paths.available(entry.ZipPath)
+			}
+		}
+
+		if entry.ZipPath != strings.TrimPrefix(path.Clean(file.Filename), "/") {
+			z.Renamed = append(z.Renamed, NameChange{Original: file.Filename, Sanitized: entry.ZipPath})
+		}
+
+		paths.add(entry)
+		z.Entries = append(z.Entries, entry)
 	}
 
-	z := ZipStreamer{Entries: entries}
+	if err := checkSymlinks(z.Entries); err != nil {
+		return nil, err
+	}
 
 	return &z, nil
 }
 
 func (z *ZipStreamer) StreamFiles(w io.Writer) error {
-	zipWriter := zip.NewWriter(w)
+	return z.StreamFilesContext(context.Background(), w)
+}
+
+// StreamFilesContext is like StreamFiles, spans and upstream requests being attached to ctx.
+// Once ctx is done, the upstream requests are canceled and an error wrapping ErrClientAborted is returned,
+// or the cause of the cancellation when one is given.
+func (z *ZipStreamer) StreamFilesContext(ctx context.Context, w io.Writer) error {
+	counter := &countingWriter{w: w}
+	zipWriter := zip.NewWriter(counter)
+
+	for i, entry := range z.Entries {
+		if ctx.Err() != nil {
+			return clientAborted(ctx)
+		}
+
+		z.reportProgress(ProgressEvent{Entry: entry, Index: i, ArchiveBytes: counter.written})
+
+		written, err := z.writeEntry(ctx, zipWriter, entry)
+		if err != nil && z.skippable(ctx, entry, err) {
+			z.Failed = append(z.Failed, EntryFailure{Path: entry.ZipPath, Url: entry.Url, Error: err.Error()})
+			z.reportProgress(ProgressEvent{Entry: entry, Index: i, Done: true, ArchiveBytes: counter.written, Err: err})
+			continue
+		}
+
+		if err != nil && ctx.Err() != nil {
+			return &EntryError{Entry: entry, Err: clientAborted(ctx)}
+		}
 
-	for _, entry := range z.Entries {
-		err := z.writeEntry(zipWriter, entry)
 		if err != nil {
-			fmt.Println("Error while writing file to stream", entry.ZipPath, ":", err.Error())
+			return &EntryError{Entry: entry, Err: err}
+		}
+
+		if z.OnProgress != nil {
+			// flush so that the reported archive size includes the entry
+			if err := zipWriter.Flush(); err != nil {
+				return err
+			}
+			z.reportProgress(ProgressEvent{Entry: entry, Index: i, Done: true, EntryBytes: written, ArchiveBytes: counter.written})
+		}
+	}
+
+	if len(z.Failed) > 0 {
+		if err := z.writeErrorReport(zipWriter); err != nil {
+			return err
+		}
+	}
+
+	if z.Checksums != "" {
+		if err := z.writeChecksums(zipWriter); err != nil {
+			return err
+		}
+	}
+
+	if z.Comment != "" {
+		if err := zipWriter.SetComment(z.Comment); err != nil {
 			return err
 		}
 	}
@@ -47,28 +216,146 @@ func (z *ZipStreamer) StreamFiles(w io.Writer) error {
 	return zipWriter.Close()
 }
 
-func (z *ZipStreamer) writeEntry(zipWriter *zip.Writer, entry *Entry) error {
-	content, err := entry.Content()
+// Upstream failures of optional entries, or of any entry with ErrorSkip, unless the client is gone
+func (z *ZipStreamer) skippable(ctx context.Context, entry *Entry, err error) bool {
+	var upstreamErr *upstreamError
+	if ctx.Err() != nil || !errors.As(err, &upstreamErr) {
+		return false
+	}
+
+	return z.mayLeaveOut(entry)
+}
+
+func (z *ZipStreamer) reportProgress(event ProgressEvent) {
+	if z.OnProgress != nil {
+		z.OnProgress(event)
+	}
+}
+
+func (z *ZipStreamer) writeEntry(ctx context.Context, zipWriter *zip.Writer, entry *Entry) (written int64, err error) {
+	ctx, span := tracer().Start(ctx, "writeEntry", trace.WithAttributes(
+		attribute.String("zipfly.entry.path", entry.ZipPath),
+		attribute.String("zipfly.entry.url", spanUrl(entry.Url)),
+	))
+	defer func() {
+		if err != nil {
+			recordSpanError(span, err)
+		}
+		span.End()
+	}()
+
+	// before fetching the content
+	if err := z.NameEncoding.checkName(entry.ZipPath); err != nil {
+		return 0, err
+	}
+
+	if entry.Target != "" {
+		return z.writeSymlink(zipWriter, entry)
+	}
+
+	content, err := entry.ContentContext(ctx)
 	if err != nil {
-		return err
+		return 0, &upstreamError{err}
 	}
 
 	defer content.Close()
 
+	source := &upstreamReader{r: content, ctx: ctx}
+	var reader io.Reader = source
+	if entry.MaxBytes > 0 {
+		reader = &limitedReader{r: source, remaining: entry.MaxBytes}
+	}
+
+	if z.mayLeaveOut(entry) {
+		spooled, err := spool(reader, z.maxSpoolBytes())
+		if err != nil && (source.err != nil || errors.Is(err, errSpoolTooLarge)) {
+			return 0, &upstreamError{err}
+		}
+
+		if err != nil {
+			return 0, err
+		}
+
+		defer spooled.Close()
+		reader = spooled
+	}
+
 	header := &zip.FileHeader{
 		Name:     entry.ZipPath,
 		Method:   entry.CompressionMethod,
 		Modified: time.Now(),
 	}
+	if err := z.NameEncoding.encodeHeader(header); err != nil {
+		return 0, err
+	}
+	entry.applyMetadata(header)
+
 	entryWriter, err := zipWriter.CreateHeader(header)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
-	_, err = io.Copy(entryWriter, bufio.NewReader(content))
-	if err != nil {
-		return err
+	// hashed as it's copied
+	var checksum hash.Hash
+	if z.Checksums != "" {
+		checksum = sha256.New()
+		reader = io.TeeReader(reader, checksum)
+	}
+
+	written, err = io.Copy(entryWriter, bufio.NewReader(reader))
+	span.SetAttributes(attribute.Int64("zipfly.entry.bytes", written))
+
+	if err != nil && source.err != nil {
+		return written, &upstreamError{err}
+	}
+
+	if err == nil && checksum != nil {
+		z.EntryChecksums = append(z.EntryChecksums, EntryChecksum{
+			Path:   entry.ZipPath,
+			Size:   written,
+			Sha256: hex.EncodeToString(checksum.Sum(nil)),
+			Url:    entry.Url,
+		})
+	}
+
+	return written, err
+}
+
+// ErrClientAborted is wrapped by the errors of the streams stopped because their context is done,
+// when the client disconnected
+var ErrClientAborted = errors.New("client aborted")
+
+// A context canceled with a cause other than the client leaving, e.g. a server shutdown, returns it
+func clientAborted(ctx context.Context) error {
+	cause := context.Cause(ctx)
+	if cause != context.Canceled && cause != context.DeadlineExceeded {
+		return cause
 	}
 
-	return nil
+	return fmt.Errorf("%w: %v", ErrClientAborted, cause)
+}
+
+// EntryError is returned when an entry couldn't be fetched or written
+type EntryError struct {
+	Entry *Entry
+	Err   error
+}
+
+func (e *EntryError) Error() string {
+	return e.Entry.ZipPath + ": " + e.Err.Error()
+}
+
+func (e *EntryError) Unwrap() error {
+	return e.Err
+}
+
+type countingWriter struct {
+	w       io.Writer
+	written int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.written += int64(n)
+	return n, err
 }
@@ -0,0 +1,222 @@
+package zipfly
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/gorilla/handlers"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tenantHeader = "X-Zipfly-Tenant"
+
+// Tenant names are used as path segment and subdomain
+var tenantNameFormat = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`)
+
+// Returned when a URL of the archive isn't on a host allowed for the tenant
+var errHostNotAllowed = errors.New("host not allowed")
+
+// Tenant has its own signing keys and policy, the global ServerOptions don't apply to its requests.
+// Limits and allowed hosts are unrestricted when not set.
+type Tenant struct {
+	SigningSecret   string `yaml:"signing_secret" secret:"true"`
+	SigningKeysFile string `yaml:"signing_keys_file"`
+	// Hosts of the manifests and files, "*.example.com" matches the subdomains of example.com
+	AllowedHosts       []string `yaml:"allowed_hosts"`
+	MaxBytes           int64    `yaml:"max_bytes"`
+	MaxEntries         int      `yaml:"max_entries"`
+	MaxBytesPerSecond  int64    `yaml:"max_bytes_per_second"`
+	CorsAllowedOrigins []string `yaml:"cors_allowed_origins"`
+	// Archive filename when the request gives none, defaults to archive.zip
+	DefaultFilename string `yaml:"default_filename"`
+
+	// Named keys, loaded from SigningKeysFile by Config.ServerOptions
+	SigningKeys *KeySet `yaml:"-"`
+
+	name string
+	cors func(http.Handler) http.Handler
+}
+
+type tenantContextKey struct{}
+
+// The tenant of a request is given by the /t/{tenant} path prefix, the subdomain, the tenant query
+// string param or the X-Zipfly-Tenant header. The header isn't signed, but whatever gives the tenant,
+// the request is only validated with the keys of this tenant.
+func (s *Server) requestTenantName(req *http.Request) string {
+	if rest, ok := strings.CutPrefix(req.URL.Path, "/t/"); ok {
+		name, _, _ := strings.Cut(rest, "/")
+		return name
+	}
+
+	host := req.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if subdomain, _, ok := strings.Cut(host, "."); ok && s.options.Tenants[strings.ToLower(subdomain)] != nil {
+		return strings.ToLower(subdomain)
+	}
+
+	if name := req.URL.Query().Get("tenant"); name != "" {
+		return name
+	}
+
+	return req.Header.Get(tenantHeader)
+}
+
+// Resolves the tenant of the request and applies its CORS policy, unknown tenants get a 404
+func (s *Server) serveTenant(w http.ResponseWriter, req *http.Request) {
+	name := s.requestTenantName(req)
+	if name == "" {
+		s.cors(s.router).ServeHTTP(w, req)
+		return
+	}
+
+	tenant := s.options.Tenants[name]
+	if tenant == nil {
+		http.Error(w, "unknown tenant", http.StatusNotFound)
+		return
+	}
+
+	trace.SpanFromContext(req.Context()).SetAttributes(attribute.String("zipfly.tenant", name))
+
+	ctx := context.WithValue(req.Context(), tenantContextKey{}, tenant)
+	tenant.cors(s.router).ServeHTTP(w, req.WithContext(ctx))
+}
+
+// Returns the tenant of the request, nil when it uses the global options
+func requestTenant(req *http.Request) *Tenant {
+	tenant, _ := req.Context().Value(tenantContextKey{}).(*Tenant)
+	return tenant
+}
+
+// Puts the tenant selected by a token in the context of the request, like serveTenant for the other
+// ones, so that its allowed hosts also apply to the redirects. Its CORS policy replaces the global one,
+// except for the preflight requests which are sent without the token.
+func (s *Server) withTokenTenant(w http.ResponseWriter, req *http.Request, tenant *Tenant) *http.Request {
+	if tenant == nil || requestTenant(req) == tenant {
+		return req
+	}
+
+	trace.SpanFromContext(req.Context()).SetAttributes(attribute.String("zipfly.tenant", tenant.name))
+
+	for _, header := range []string{"Access-Control-Allow-Origin", "Access-Control-Allow-Credentials", "Access-Control-Expose-Headers", "Vary"} {
+		w.Header().Del(header)
+	}
+	tenant.cors(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})).ServeHTTP(w, req)
+
+	return req.WithContext(context.WithValue(req.Context(), tenantContextKey{}, tenant))
+}
+
+// Logs a line about a request, labelled with its tenant when it has one
+func logWithTenant(tenant *Tenant, args ...interface{}) {
+	if tenant != nil {
+		args = append(args, "tenant:", tenant.name)
+	}
+
+	fmt.Println(args...)
+}
+
+func corsHandler(origins []string) func(http.Handler) http.Handler {
+	originsOk := handlers.AllowedOrigins(origins)
+	headersOk := handlers.AllowedHeaders([]string{"Content-Type", "X-Requested-With", "*"})
+	methodsOk := handlers.AllowedMethods([]string{"GET", "HEAD", "POST", "PUT", "OPTIONS"})
+	exposedOk := handlers.ExposedHeaders([]string{streamIdHeader})
+	return handlers.CORS(originsOk, headersOk, methodsOk, exposedOk)
+}
+
+// A token with a tenant claim selects the tenant, it must match the one of the request if any
+func (s *Server) tokenTenant(claims *zipClaims, tenant *Tenant) (*Tenant, bool) {
+	if claims == nil || claims.Tenant == "" {
+		return tenant, true
+	}
+
+	if tenant != nil {
+		return tenant, tenant.name == claims.Tenant
+	}
+
+	tenant = s.options.Tenants[claims.Tenant]
+	return tenant, tenant != nil
+}
+
+func (t *Tenant) Name() string {
+	if t == nil {
+		return ""
+	}
+
+	return t.name
+}
+
+func (t *Tenant) checkHost(rawUrl string) error {
+	if t == nil || len(t.AllowedHosts) == 0 {
+		return nil
+	}
+
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return err
+	}
+
+	host := strings.ToLower(u.Hostname())
+	for _, allowed := range t.AllowedHosts {
+		allowed = strings.ToLower(allowed)
+		if host == allowed {
+			return nil
+		}
+
+		if suffix, ok := strings.CutPrefix(allowed, "*."); ok && strings.HasSuffix(host, "."+suffix) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%w: %s", errHostNotAllowed, host)
+}
+
+// Copies the client so that each redirect of a tenant request is checked against its allowed hosts,
+// the tenant being read from the request context
+func checkTenantRedirects(client *http.Client) *http.Client {
+	checked := *client
+	checkRedirect := client.CheckRedirect
+
+	checked.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		tenant, _ := req.Context().Value(tenantContextKey{}).(*Tenant)
+		if err := tenant.checkHost(req.URL.String()); err != nil {
+			return err
+		}
+
+		if checkRedirect != nil {
+			return checkRedirect(req, via)
+		}
+
+		// the net/http default
+		if len(via) >= 10 {
+			return errors.New("stopped after 10 redirects")
+		}
+
+		return nil
+	}
+
+	return &checked
+}
+
+// Applies the tenant defaults and limits to the payload, the lowest limit wins
+func (t *Tenant) apply(payload *zipPayload) {
+	payload.tenant = t
+	if t == nil {
+		return
+	}
+
+	if payload.Filename == "" {
+		payload.Filename = t.DefaultFilename
+	}
+
+	payload.maxBytes = lowerLimit(payload.maxBytes, t.MaxBytes)
+	payload.maxEntries = int(lowerLimit(int64(payload.maxEntries), int64(t.MaxEntries)))
+	payload.maxBytesPerSecond = lowerLimit(payload.maxBytesPerSecond, t.MaxBytesPerSecond)
+}
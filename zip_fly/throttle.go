@@ -0,0 +1,104 @@
+package zipfly
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// Bytes written at once by a throttled stream, small enough for the streams to share the global rate fairly
+const throttleChunk = 16 * 1024
+
+// BandwidthOptions caps the bytes per second sent to the clients, 0 for no limit.
+// The rate of a stream is the lowest of StreamBytesPerSecond, its tenant, its token and its manifest.
+type BandwidthOptions struct {
+	StreamBytesPerSecond int64 `yaml:"stream_bytes_per_second" usage:"maximum download speed of each archive in bytes per second, 0 for none"`
+	GlobalBytesPerSecond int64 `yaml:"global_bytes_per_second" usage:"maximum download speed of all the archives in bytes per second, 0 for none"`
+}
+
+// bandwidthLimiter is a token bucket of bytes. Reservations go into debt, so that the streams waiting
+// on it are served in turn.
+type bandwidthLimiter struct {
+	rate float64
+
+	mu        sync.Mutex
+	tokens    float64
+	updatedAt time.Time
+}
+
+func newBandwidthLimiter(bytesPerSecond int64) *bandwidthLimiter {
+	return &bandwidthLimiter{rate: float64(bytesPerSecond), tokens: throttleChunk, updatedAt: time.Now()}
+}
+
+// Takes n bytes and returns how long to wait before sending them
+func (l *bandwidthLimiter) reserve(n int) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.tokens = min(throttleChunk, l.tokens+now.Sub(l.updatedAt).Seconds()*l.rate)
+	l.updatedAt = now
+	l.tokens -= float64(n)
+
+	if l.tokens >= 0 {
+		return 0
+	}
+
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+// throttledWriter sends the bytes in chunks, waiting for each of its limiters
+type throttledWriter struct {
+	w        io.Writer
+	ctx      context.Context
+	limiters []*bandwidthLimiter
+}
+
+func (t *throttledWriter) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		chunk := p[written:min(len(p), written+throttleChunk)]
+
+		var delay time.Duration
+		for _, limiter := range t.limiters {
+			delay = max(delay, limiter.reserve(len(chunk)))
+		}
+
+		if delay > 0 {
+			timer := time.NewTimer(delay)
+			select {
+			case <-timer.C:
+			case <-t.ctx.Done():
+				timer.Stop()
+				return written, context.Cause(t.ctx)
+			}
+		}
+
+		n, err := t.w.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+
+	return written, nil
+}
+
+// Wraps the client writer with the stream and global rates, w is returned as is when none applies
+func (s *Server) throttle(ctx context.Context, w io.Writer, bytesPerSecond int64) io.Writer {
+	var limiters []*bandwidthLimiter
+	if bytesPerSecond > 0 {
+		limiters = append(limiters, newBandwidthLimiter(bytesPerSecond))
+	}
+
+	if s.bandwidth != nil {
+		limiters = append(limiters, s.bandwidth)
+	}
+
+	if len(limiters) == 0 {
+		return w
+	}
+
+	return &throttledWriter{w: w, ctx: ctx, limiters: limiters}
+}
@@ -0,0 +1,160 @@
+package zipfly
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Returned when an upstream sends no data for longer than the idle read timeout
+var errUpstreamStalled = errors.New("upstream stalled, no data received within the idle read timeout")
+
+// UpstreamOptions tunes the HTTP client used to fetch manifests and files.
+// Zero values keep the net/http defaults.
+type UpstreamOptions struct {
+	DialTimeout           time.Duration `yaml:"dial_timeout" usage:"timeout to establish upstream connections"`
+	TLSHandshakeTimeout   time.Duration `yaml:"tls_handshake_timeout" usage:"timeout of the upstream TLS handshakes"`
+	ResponseHeaderTimeout time.Duration `yaml:"response_header_timeout" usage:"timeout to receive upstream response headers"`
+	// Applies to each read of a response body, a slow but steady upstream isn't stopped
+	IdleReadTimeout     time.Duration `yaml:"idle_read_timeout" usage:"maximum time without receiving data from an upstream response, 0 for none"`
+	MaxConnsPerHost     int           `yaml:"max_conns_per_host" usage:"maximum connections to each upstream host, 0 for no limit"`
+	MaxIdleConnsPerHost int           `yaml:"max_idle_conns_per_host" usage:"idle connections kept open to each upstream host"`
+	IdleConnTimeout     time.Duration `yaml:"idle_conn_timeout" usage:"how long an idle upstream connection is kept open"`
+	KeepAlive           time.Duration `yaml:"keep_alive" usage:"interval of the TCP keep-alive probes of upstream connections"`
+	DisableHTTP2        bool          `yaml:"disable_http2" usage:"only use HTTP/1.1 with upstreams"`
+}
+
+// Defaults of the zipfly binary, so that a stalled upstream can't hang a stream
+var defaultUpstreamOptions = UpstreamOptions{
+	DialTimeout:           10 * time.Second,
+	TLSHandshakeTimeout:   10 * time.Second,
+	ResponseHeaderTimeout: 30 * time.Second,
+	IdleReadTimeout:       time.Minute,
+}
+
+// Client used when none is configured (e.g. entries built outside of a Server)
+var upstreamClient = newUpstreamClient(UpstreamOptions{}, nil)
+
+// The control function, when given, can refuse the address of each connection
+func newUpstreamClient(options UpstreamOptions, control func(network, address string, c syscall.RawConn) error) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	if options.DialTimeout > 0 || options.KeepAlive > 0 || control != nil {
+		dialer := &net.Dialer{Timeout: options.DialTimeout, KeepAlive: 30 * time.Second, Control: control}
+		if options.KeepAlive > 0 {
+			dialer.KeepAlive = options.KeepAlive
+		}
+		transport.DialContext = dialer.DialContext
+	}
+
+	// a proxy would be dialed instead of the checked hosts
+	if control != nil {
+		transport.Proxy = nil
+	}
+
+	if options.TLSHandshakeTimeout > 0 {
+		transport.TLSHandshakeTimeout = options.TLSHandshakeTimeout
+	}
+
+	if options.ResponseHeaderTimeout > 0 {
+		transport.ResponseHeaderTimeout = options.ResponseHeaderTimeout
+	}
+
+	if options.MaxConnsPerHost > 0 {
+		transport.MaxConnsPerHost = options.MaxConnsPerHost
+	}
+
+	if options.MaxIdleConnsPerHost > 0 {
+		transport.MaxIdleConnsPerHost = options.MaxIdleConnsPerHost
+	}
+
+	if options.IdleConnTimeout > 0 {
+		transport.IdleConnTimeout = options.IdleConnTimeout
+	}
+
+	if options.DisableHTTP2 {
+		// a non-nil empty map turns off the HTTP/2 upgrade
+		transport.ForceAttemptHTTP2 = false
+		transport.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+	}
+
+	var base http.RoundTripper = transport
+	if options.IdleReadTimeout > 0 {
+		base = &idleReadTransport{base: transport, timeout: options.IdleReadTimeout}
+	}
+
+	return &http.Client{Transport: &tracingTransport{base: base}}
+}
+
+// idleReadTransport cancels the requests whose response body stalls
+type idleReadTransport struct {
+	base    http.RoundTripper
+	timeout time.Duration
+}
+
+func (t *idleReadTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, cancel := context.WithCancel(req.Context())
+
+	resp, err := t.base.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	body := &idleTimeoutBody{body: resp.Body, cancel: cancel, timeout: t.timeout}
+	body.timer = time.AfterFunc(t.timeout, body.expire)
+	body.timer.Stop()
+	resp.Body = body
+
+	return resp, nil
+}
+
+type idleTimeoutBody struct {
+	body    io.ReadCloser
+	cancel  context.CancelFunc
+	timeout time.Duration
+	timer   *time.Timer
+
+	mu       sync.Mutex
+	timedOut bool
+}
+
+func (b *idleTimeoutBody) expire() {
+	b.mu.Lock()
+	b.timedOut = true
+	b.mu.Unlock()
+
+	b.cancel()
+}
+
+// Only the time waiting on the upstream counts, not the time the consumer takes between two reads
+func (b *idleTimeoutBody) Read(p []byte) (int, error) {
+	b.timer.Reset(b.timeout)
+	n, err := b.body.Read(p)
+	b.timer.Stop()
+
+	if err == nil {
+		return n, nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.timedOut {
+		return n, errUpstreamStalled
+	}
+
+	return n, err
+}
+
+func (b *idleTimeoutBody) Close() error {
+	b.timer.Stop()
+	defer b.cancel()
+
+	return b.body.Close()
+}
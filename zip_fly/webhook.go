@@ -0,0 +1,235 @@
+package zipfly
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// WebhookOptions configures the delivery of the manifest callback_url notifications
+type WebhookOptions struct {
+	MaxAttempts    int           `yaml:"max_attempts" usage:"maximum delivery attempts of a webhook event"`
+	Timeout        time.Duration `yaml:"timeout" usage:"timeout of each webhook delivery attempt"`
+	InitialBackoff time.Duration `yaml:"initial_backoff" usage:"delay before the first webhook retry, doubled at each attempt"`
+	// By default, the callback URLs resolving to loopback, private, link-local (cloud metadata) or
+	// unspecified addresses are refused when connecting, so that a manifest can't reach internal services
+	AllowPrivateNetworks bool `yaml:"allow_private_networks" usage:"allow callback URLs on loopback, private and link-local addresses"`
+}
+
+var defaultWebhookOptions = WebhookOptions{MaxAttempts: 5, Timeout: 10 * time.Second, InitialBackoff: time.Second}
+
+// Replaces each zero option by its default
+func (o WebhookOptions) withDefaults() WebhookOptions {
+	if o.MaxAttempts <= 0 {
+		o.MaxAttempts = defaultWebhookOptions.MaxAttempts
+	}
+
+	if o.Timeout <= 0 {
+		o.Timeout = defaultWebhookOptions.Timeout
+	}
+
+	if o.InitialBackoff <= 0 {
+		o.InitialBackoff = defaultWebhookOptions.InitialBackoff
+	}
+
+	return o
+}
+
+var errCallbackAddressForbidden = errors.New("callback address forbidden")
+
+// Shared address space of carrier-grade NATs, where some clouds serve their metadata
+var sharedAddressSpace = netip.MustParsePrefix("100.64.0.0/10")
+
+// webhookDeliveries tracks the webhooks being delivered, so that Drain waits for them
+type webhookDeliveries struct {
+	client  *http.Client
+	options WebhookOptions
+	wg      sync.WaitGroup
+	// canceled to abort the deliveries on shutdown
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func newWebhookDeliveries(upstream UpstreamOptions, options WebhookOptions) *webhookDeliveries {
+	var control func(network, address string, c syscall.RawConn) error
+	if !options.AllowPrivateNetworks {
+		control = checkCallbackAddress
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	client := checkTenantRedirects(newUpstreamClient(upstream, control))
+
+	return &webhookDeliveries{client: client, options: options, ctx: ctx, cancel: cancel}
+}
+
+// Refuses the connections to the private addresses, once the host is resolved so that a DNS record
+// can't point to them either
+func checkCallbackAddress(network, address string, c syscall.RawConn) error {
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return err
+	}
+
+	ip := addrPort.Addr().Unmap()
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() || sharedAddressSpace.Contains(ip) {
+		return fmt.Errorf("%w: %s", errCallbackAddressForbidden, ip)
+	}
+
+	return nil
+}
+
+// Waits for the deliveries in progress, aborting them when ctx is done first
+func (d *webhookDeliveries) wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		d.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		d.abort()
+		return ctx.Err()
+	}
+}
+
+// Cancels the deliveries in progress and their retries, and waits for them to return
+func (d *webhookDeliveries) abort() {
+	d.cancel()
+	d.wg.Wait()
+}
+
+// Validity of the webhook signatures
+const webhookSignatureValidity = 5 * time.Minute
+
+const (
+	webhookCompleted = "archive.completed"
+	webhookFailed    = "archive.failed"
+	webhookAborted   = "archive.aborted"
+)
+
+type webhookEvent struct {
+	Event     string `json:"event"`
+	StreamId  string `json:"stream_id"`
+	Timestamp int64  `json:"timestamp"`
+	resultEventData
+}
+
+// Sends the archive result to the callback URL in the background
+func (s *Server) notifyCallback(payload *zipPayload, streamId string, result resultEventData) {
+	if payload.CallbackUrl == "" {
+		return
+	}
+
+	event := webhookEvent{Event: webhookCompleted, StreamId: streamId, Timestamp: time.Now().Unix(), resultEventData: result}
+	if result.Aborted {
+		event.Event = webhookAborted
+	} else if result.Error != "" {
+		event.Event = webhookFailed
+	}
+
+	body, err := json.Marshal(event)
+	if err != nil {
+		logWithTenant(payload.tenant, "Webhook error for", result.Filename, ":", err.Error())
+		return
+	}
+
+	s.webhooks.wg.Add(1)
+	go func() {
+		defer s.webhooks.wg.Done()
+		s.deliverWebhook(payload.tenant, payload.CallbackUrl, body)
+	}()
+}
+
+// Retries with an exponential backoff on network errors, 429 and 5xx responses, until the server
+// shuts down
+func (s *Server) deliverWebhook(tenant *Tenant, callbackUrl string, body []byte) {
+	options := s.webhooks.options
+	backoff := options.InitialBackoff
+
+	for attempt := 1; ; attempt++ {
+		retry, err := s.postWebhook(tenant, callbackUrl, body)
+		if err == nil {
+			return
+		}
+
+		if !retry || attempt >= options.MaxAttempts || s.webhooks.ctx.Err() != nil {
+			logWithTenant(tenant, "Webhook delivery to", callbackUrl, "failed after", attempt, "attempt(s):", err.Error())
+			return
+		}
+
+		select {
+		case <-time.After(backoff):
+		case <-s.webhooks.ctx.Done():
+			logWithTenant(tenant, "Webhook delivery to", callbackUrl, "aborted by the shutdown after", attempt, "attempt(s):", err.Error())
+			return
+		}
+		backoff *= 2
+	}
+}
+
+// Signs the event like a POST /zip request: HMAC of "expires:body", in the X-Zipfly-Signature and
+// X-Zipfly-Expires headers, with X-Zipfly-Key-Id when signed by a key of the key set
+func (s *Server) postWebhook(tenant *Tenant, callbackUrl string, body []byte) (bool, error) {
+	// the redirects are checked against the hosts of the tenant
+	ctx, cancel := context.WithTimeout(context.WithValue(s.webhooks.ctx, tenantContextKey{}, tenant), s.webhooks.options.Timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, callbackUrl, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	if kid, secret := s.outgoingSigningKey(tenant); secret != "" {
+		expires := strconv.FormatInt(time.Now().Add(webhookSignatureValidity).Unix(), 10)
+		req.Header.Set("X-Zipfly-Expires", expires)
+		req.Header.Set("X-Zipfly-Signature", signHMAC([]byte(expires+":"+string(body)), []byte(secret)))
+		if kid != "" {
+			req.Header.Set("X-Zipfly-Key-Id", kid)
+		}
+	}
+
+	resp, err := s.webhooks.client.Do(req)
+	if errors.Is(err, errCallbackAddressForbidden) {
+		return false, err
+	}
+
+	if err != nil {
+		return true, err
+	}
+
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		retry := resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= http.StatusInternalServerError
+		return retry, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	return false, nil
+}
+
+func validateCallbackUrl(callbackUrl string) error {
+	if callbackUrl == "" {
+		return nil
+	}
+
+	u, err := url.Parse(callbackUrl)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("invalid callback url")
+	}
+
+	return nil
+}